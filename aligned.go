@@ -0,0 +1,91 @@
+//
+// Copyright 2018 Daniel Reiter Horn
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS
+// OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rsync
+
+import "github.com/danielrh/go-rsync/rollsum"
+
+// consume_aligned is consume for DeltaOptions.Aligned: it only tests windows
+// on the block grid, apart from rolling over the RollAfterMiss bytes following
+// each miss. The grid starts at offset 0 and moves to follow any match found
+// while rolling, so data shifted by an insertion is followed once found.
+func (self *RsyncPatchWriter) consume_aligned(buf []byte, stop int) (int, error) {
+	block_size := int(self.sig.block_size)
+	limit := min(stop, len(buf)-block_size+1)
+	pos := 0
+	lit := 0
+	for pos < limit {
+		offset := self.buf_offset + int64(pos)
+		var match int
+		if offset < self.roll_until {
+			scan_limit := min(limit, pos+int(self.roll_until-offset))
+			scan_limit = min(scan_limit, lit+self.max_literal_run-len(self.pending_literals))
+			pos, match, _ = self.matcher.scan(buf, pos, scan_limit, rollsum.Checksum(buf[pos:pos+block_size]))
+		} else {
+			// skipping to the next aligned window, if buf holds one
+			skip := int(((self.grid-offset)%int64(block_size) + int64(block_size)) % int64(block_size))
+			if pos+skip >= limit {
+				pos = limit
+				break
+			}
+			pos += skip
+			window := buf[pos : pos+block_size]
+			match = self.matcher.lookup(rollsum.Checksum(window), window)
+			if match < 0 {
+				if self.roll_after_miss != 0 {
+					self.roll_until = self.buf_offset + int64(pos) + 1 + self.roll_after_miss
+					pos += 1
+				} else {
+					pos += block_size
+				}
+			}
+		}
+		if match >= 0 {
+			self.grid = (self.buf_offset + int64(pos)) % int64(block_size)
+			// a skip can take the literals before the match past max_literal_run
+			if err := self.emit_literals(buf[lit:pos]); err != nil {
+				return pos, err
+			}
+			if err := self.flush_literals(nil, false); err != nil {
+				return pos, err
+			}
+			if err := self.emit_copy(match*block_size, block_size); err != nil {
+				return pos, err
+			}
+			pos += block_size
+			lit = pos
+			continue
+		}
+		// a missed block can take the literal run past max_literal_run
+		for len(self.pending_literals)+pos-lit >= self.max_literal_run {
+			cut := lit + self.max_literal_run - len(self.pending_literals)
+			if err := self.flush_literals(buf[lit:cut], false); err != nil {
+				return pos, err
+			}
+			lit = cut
+		}
+	}
+	if err := self.emit_literals(buf[lit:pos]); err != nil {
+		return pos, err
+	}
+	return pos, nil
+}
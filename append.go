@@ -0,0 +1,150 @@
+//
+// Copyright 2018 Daniel Reiter Horn
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS
+// OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rsync
+
+import (
+	"bytes"
+
+	"github.com/danielrh/go-rsync/rollsum"
+)
+
+// appendState tracks DeltaOptions.AppendOnly
+type appendState int
+
+const (
+	appendOff      appendState = iota // normal rolling search
+	appendScanning                    // every block so far matched the signature in order
+	appendTail                        // the whole basis matched; the rest is literal
+)
+
+// matches reports whether window has the weak and strong sums of block index
+func (self *blockMatcher) matches(index int, sum uint32, window []byte) bool {
+	expected := self.sig.signatures[index]
+	if sum != expected.crc32 {
+		return false
+	}
+	self.stats.WeakHits += 1
+	self.hasher.Reset()
+	_, _ = self.hasher.Write(window)
+	if bytes.Equal(self.hasher.Sum(self.digest[:0])[:len(expected.crypto_hash)], expected.crypto_hash) {
+		return true
+	}
+	self.stats.FalseMatches += 1
+	return false
+}
+
+// match_prefix_block checks the tail against the next signature block,
+// returning how many bytes of it matched or -1. Since the signature doesn't
+// record how long its final block is, every length is tried for that one.
+func (self *RsyncPatchWriter) match_prefix_block() int {
+	index := self.prefix_blocks
+	last := len(self.sig.signatures) - 1
+	if index < last {
+		if len(self.tail) == int(self.sig.block_size) &&
+			self.matcher.matches(index, rollsum.Checksum(self.tail), self.tail) {
+			return len(self.tail)
+		}
+		return -1
+	}
+	var sum rollsum.Rollsum
+	for length, item := range self.tail {
+		sum.Rollin(item)
+		if self.matcher.matches(index, sum.Sum32(), self.tail[:length+1]) {
+			return length + 1
+		}
+	}
+	return -1
+}
+
+// write_append is write while the input still matches the signature block by
+// block from the start
+func (self *RsyncPatchWriter) write_append(data []byte) (int, error) {
+	self.stats.InBytes += int64(len(data))
+	block_size := int(self.sig.block_size)
+	for index := 0; index < len(data); {
+		take := min(block_size-len(self.tail), len(data)-index)
+		self.tail = append(self.tail, data[index:index+take]...)
+		index += take
+		if len(self.tail) < block_size {
+			break
+		}
+		matched := self.match_prefix_block()
+		if matched < 0 {
+			return len(data), self.end_append(data[index:])
+		}
+		self.prefix_blocks += 1
+		if self.prefix_blocks == len(self.sig.signatures) {
+			return len(data), self.finish_append(matched, data[index:])
+		}
+		self.tail = self.tail[:0]
+	}
+	return len(data), nil
+}
+
+// finish_append copies the whole basis, the final block of which took
+// matched bytes of the tail, and sends the rest of the input as literals
+func (self *RsyncPatchWriter) finish_append(matched int, rest []byte) error {
+	self.append_state = appendTail
+	basis_length := (self.prefix_blocks-1)*int(self.sig.block_size) + matched
+	if err := self.emit_copy(0, basis_length); err != nil {
+		return err
+	}
+	tail := self.tail[matched:]
+	self.tail = self.tail[:0]
+	if err := self.emit_literals(tail); err != nil {
+		return err
+	}
+	return self.emit_literals(rest)
+}
+
+// end_append gives up on the append-only path after the tail failed to
+// match: the blocks that did match are copied and everything from the tail on
+// is written again through the rolling search.
+func (self *RsyncPatchWriter) end_append(rest []byte) error {
+	self.append_state = appendOff
+	if self.prefix_blocks != 0 {
+		if err := self.emit_copy(0, self.prefix_blocks*int(self.sig.block_size)); err != nil {
+			return err
+		}
+	}
+	pending := append([]byte(nil), self.tail...)
+	self.tail = self.tail[:0]
+	self.stats.InBytes -= int64(len(pending) + len(rest))
+	if _, err := self.write(pending); err != nil {
+		return err
+	}
+	_, err := self.write(rest)
+	return err
+}
+
+// close_append settles the append-only path at Close, where the tail may hold
+// the basis' short final block
+func (self *RsyncPatchWriter) close_append() error {
+	if self.prefix_blocks == len(self.sig.signatures)-1 {
+		if matched := self.match_prefix_block(); matched >= 0 {
+			self.prefix_blocks += 1
+			return self.finish_append(matched, nil)
+		}
+	}
+	return self.end_append(nil)
+}
@@ -0,0 +1,167 @@
+//
+// Copyright 2018 Daniel Reiter Horn
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS
+// OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package cdc cuts data into content-defined chunks with FastCDC. A gear hash
+// runs over the data and a chunk ends where enough of the hash's top bits are
+// zero. Normalized chunking asks for more zero bits before the average length
+// and fewer after it, so lengths cluster around the average. Since a boundary
+// depends only on the 64 bytes before it, an edit moves the boundaries near
+// it and leaves the rest of the data cut exactly as before.
+package cdc
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// Params are the shortest, average and longest chunk lengths
+type Params struct {
+	Min int `json:"min"`
+	Avg int `json:"avg"`
+	Max int `json:"max"`
+}
+
+// DefaultAvg is the average chunk length of NewParams(0)
+const DefaultAvg = 8192
+
+// MaxSize is the longest chunk Params can ask for
+const MaxSize = 1 << 30
+
+// NewParams returns the FastCDC paper's proportions for an average of avg
+// bytes, DefaultAvg if 0: chunks from a quarter of it to eight times it.
+func NewParams(avg int) Params {
+	if avg == 0 {
+		avg = DefaultAvg
+	}
+	return Params{Min: avg / 4, Avg: avg, Max: avg * 8}
+}
+
+// Validate reports whether Min, Avg and Max can be used to cut chunks
+func (self Params) Validate() error {
+	if self.Min <= 0 || self.Min > self.Avg || self.Avg > self.Max || self.Max > MaxSize {
+		return fmt.Errorf("Chunk lengths %d/%d/%d are not ordered within 1..%d", self.Min, self.Avg, self.Max, MaxSize)
+	}
+	if self.Avg < 8 {
+		return fmt.Errorf("Average chunk length %d is shorter than 8", self.Avg)
+	}
+	return nil
+}
+
+// masks returns the bits that must be zero for a boundary before and after
+// the average length
+func (self Params) masks() (uint64, uint64) {
+	avg_bits := bits.Len(uint(self.Avg)) - 1
+	return ^uint64(0) << (64 - avg_bits - 2), ^uint64(0) << (64 - avg_bits + 2)
+}
+
+// Cut returns the length of the first chunk of data: up to the first boundary
+// at least Min bytes in, or Max bytes if there is none. Data shorter than Max
+// without a boundary is a single chunk, so a caller holding part of a stream
+// should only cut once it has Max bytes or the stream has ended.
+func (self Params) Cut(data []byte) int {
+	if len(data) <= self.Min {
+		return len(data)
+	}
+	end := len(data)
+	if end > self.Max {
+		end = self.Max
+	}
+	normal := self.Avg
+	if normal > end {
+		normal = end
+	}
+	small_mask, large_mask := self.masks()
+	var hash uint64
+	pos := self.Min
+	for ; pos < normal; pos++ {
+		hash = hash<<1 + gear[data[pos]]
+		if hash&small_mask == 0 {
+			return pos + 1
+		}
+	}
+	for ; pos < end; pos++ {
+		hash = hash<<1 + gear[data[pos]]
+		if hash&large_mask == 0 {
+			return pos + 1
+		}
+	}
+	return end
+}
+
+// Chunker cuts the data read from an io.Reader into chunks
+type Chunker struct {
+	params Params
+	input  io.Reader
+	buffer []byte
+	start  int
+	end    int
+	err    error
+}
+
+func NewChunker(input io.Reader, params Params) *Chunker {
+	return &Chunker{
+		params: params,
+		input:  input,
+		buffer: make([]byte, 2*params.Max),
+	}
+}
+
+// Next returns the next chunk, which is only valid until the following call,
+// or io.EOF once the input is used up
+func (self *Chunker) Next() ([]byte, error) {
+	if self.end-self.start < self.params.Max && self.err == nil {
+		self.end = copy(self.buffer, self.buffer[self.start:self.end])
+		self.start = 0
+		for self.end < len(self.buffer) && self.err == nil {
+			var n int
+			n, self.err = self.input.Read(self.buffer[self.end:])
+			self.end += n
+		}
+	}
+	if self.err != nil && self.err != io.EOF {
+		return nil, self.err
+	}
+	if self.start == self.end {
+		return nil, io.EOF
+	}
+	length := self.params.Cut(self.buffer[self.start:self.end])
+	chunk := self.buffer[self.start : self.start+length]
+	self.start += length
+	return chunk, nil
+}
+
+// gear is the table of random values the hash adds for each byte. Every chunk
+// boundary, and so every content-defined signature, depends on it, so the
+// splitmix64 seed that fills it must never change.
+var gear = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x6a09e667f3bcc908)
+	for index := range table {
+		state += 0x9e3779b97f4a7c15
+		value := state
+		value = (value ^ value>>30) * 0xbf58476d1ce4e5b9
+		value = (value ^ value>>27) * 0x94d049bb133111eb
+		table[index] = value ^ value>>31
+	}
+	return table
+}()
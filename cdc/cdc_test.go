@@ -0,0 +1,118 @@
+//
+// Copyright 2018 Daniel Reiter Horn
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS
+// OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package cdc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func cutAll(params Params, data []byte) []int {
+	var lengths []int
+	for len(data) != 0 {
+		length := params.Cut(data)
+		lengths = append(lengths, length)
+		data = data[length:]
+	}
+	return lengths
+}
+
+func TestCutLengths(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	params := NewParams(4096)
+	if err := params.Validate(); err != nil {
+		panic(err)
+	}
+	lengths := cutAll(params, data)
+	for index, length := range lengths {
+		if length > params.Max || (length < params.Min && index != len(lengths)-1) {
+			panic(fmt.Sprintf("chunk %d is %d bytes", index, length))
+		}
+	}
+	if avg := len(data) / len(lengths); avg < params.Avg/2 || avg > params.Avg*2 {
+		panic(fmt.Sprintf("average chunk length %d for %+v", avg, params))
+	}
+	// with no boundaries, every chunk is as long as it may be
+	if lengths = cutAll(params, make([]byte, 100000)); lengths[0] != params.Max {
+		panic(fmt.Sprintf("zero chunk lengths %v", lengths))
+	}
+}
+
+func TestCutSurvivesInsertion(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(2)).Read(data)
+	params := NewParams(4096)
+	edited := append(append(append([]byte(nil), data[:500000]...), "inserted"...), data[500000:]...)
+	chunks := map[string]bool{}
+	for rest, length := data, 0; len(rest) != 0; rest = rest[length:] {
+		length = params.Cut(rest)
+		chunks[string(rest[:length])] = true
+	}
+	var changed int
+	for rest, length := edited, 0; len(rest) != 0; rest = rest[length:] {
+		length = params.Cut(rest)
+		if !chunks[string(rest[:length])] {
+			changed += length
+		}
+	}
+	if changed > 3*params.Max {
+		panic(fmt.Sprintf("%d bytes of chunks changed by an 8 byte insertion", changed))
+	}
+}
+
+func TestChunkerMatchesCut(t *testing.T) {
+	data := make([]byte, 300000)
+	rand.New(rand.NewSource(3)).Read(data)
+	params := NewParams(1024)
+	expected := cutAll(params, data)
+	chunker := NewChunker(io.LimitReader(bytes.NewReader(data), int64(len(data))), params)
+	var offset int
+	for index := 0; ; index++ {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			if index != len(expected) || offset != len(data) {
+				panic(fmt.Sprintf("%d chunks, %d bytes; want %d, %d", index, offset, len(expected), len(data)))
+			}
+			return
+		}
+		if err != nil {
+			panic(err)
+		}
+		if len(chunk) != expected[index] || !bytes.Equal(chunk, data[offset:offset+len(chunk)]) {
+			panic(fmt.Sprintf("chunk %d differs", index))
+		}
+		offset += len(chunk)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, params := range []Params{{}, {Min: 10, Avg: 5, Max: 20}, {Min: 1, Avg: 4, Max: 8}, {Min: 1, Avg: 8, Max: MaxSize + 1}} {
+		if params.Validate() == nil {
+			panic(fmt.Sprintf("%+v validated", params))
+		}
+	}
+}
@@ -0,0 +1,158 @@
+//
+// Copyright 2018 Daniel Reiter Horn
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS
+// OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rsync
+
+import (
+	"github.com/danielrh/go-rsync/cdc"
+)
+
+func (self *SigFile) chunked() bool {
+	return self.chunking != cdc.Params{}
+}
+
+// Chunking is the FastCDC parameters of a content-defined signature, the zero
+// Params for one of fixed-size blocks
+func (self *SigFile) Chunking() cdc.Params {
+	return self.chunking
+}
+
+// offsets returns where each record's block starts in the basis, followed by
+// where the last one ends. Fixed-size blocks are taken to be whole.
+func (self *SigFile) offsets() []int64 {
+	ret := make([]int64, len(self.signatures)+1)
+	for index, item := range self.signatures {
+		length := int64(self.block_size)
+		if self.chunked() {
+			length = int64(item.length)
+		}
+		ret[index+1] = ret[index] + length
+	}
+	return ret
+}
+
+// chunkIndex finds the chunks of a content-defined signature by strong sum
+type chunkIndex struct {
+	sig     *SigFile
+	offsets []int64
+	by_sum  map[string]int // the first chunk with each strong sum
+}
+
+func (self *SigFile) new_chunk_index() *chunkIndex {
+	ret := &chunkIndex{
+		sig:     self,
+		offsets: self.offsets(),
+		by_sum:  make(map[string]int, len(self.signatures)),
+	}
+	for index, item := range self.signatures {
+		if _, ok := ret.by_sum[string(item.crypto_hash)]; !ok {
+			ret.by_sum[string(item.crypto_hash)] = index
+		}
+	}
+	return ret
+}
+
+// lookup returns the chunk with the given strong sum and length, or -1
+func (self *chunkIndex) lookup(sum []byte, length int) int {
+	index, ok := self.by_sum[string(sum)]
+	if !ok || int(self.sig.signatures[index].length) != length {
+		return -1
+	}
+	return index
+}
+
+// write_chunks is write for content-defined signatures. Input is held in the
+// tail until there is a maximum chunk of it to cut, so that every cut is the
+// one NewSigFile would make. Data is added a maximum chunk at a time, so the
+// tail never grows past two of them however large the write.
+func (self *RsyncPatchWriter) write_chunks(data []byte) (int, error) {
+	self.stats.InBytes += int64(len(data))
+	max_size := self.sig.chunking.Max
+	for rest := data; len(rest) != 0; {
+		piece := rest[:min(len(rest), max_size)]
+		rest = rest[len(piece):]
+		self.tail = append(self.tail, piece...)
+		start := 0
+		for len(self.tail)-start >= max_size {
+			length := self.sig.chunking.Cut(self.tail[start:])
+			if err := self.emit_chunk(self.tail[start : start+length]); err != nil {
+				return len(data), err
+			}
+			start += length
+		}
+		self.tail = self.tail[:copy(self.tail, self.tail[start:])]
+	}
+	return len(data), nil
+}
+
+// emit_chunk copies chunk from the basis if the signature has it, extending
+// the copy before it where the two are adjacent, and otherwise queues it as
+// literals
+func (self *RsyncPatchWriter) emit_chunk(chunk []byte) error {
+	self.matcher.hasher.Reset()
+	_, _ = self.matcher.hasher.Write(chunk)
+	sum := self.matcher.hasher.Sum(self.matcher.digest[:0])[:self.sig.crypto_hash_size]
+	index := self.chunks.lookup(sum, len(chunk))
+	if index < 0 {
+		if err := self.flush_chunk_copy(); err != nil {
+			return err
+		}
+		return self.emit_literals(chunk)
+	}
+	where := self.chunks.offsets[index]
+	if self.copy_length != 0 && self.copy_start+self.copy_length == where {
+		self.copy_length += int64(len(chunk))
+		return nil
+	}
+	if err := self.flush_chunk_copy(); err != nil {
+		return err
+	}
+	self.copy_start, self.copy_length = where, int64(len(chunk))
+	return nil
+}
+
+// flush_chunk_copy writes the literals queued before the copy being built,
+// then the copy
+func (self *RsyncPatchWriter) flush_chunk_copy() error {
+	if self.copy_length == 0 {
+		return nil
+	}
+	if err := self.flush_literals(nil, false); err != nil {
+		return err
+	}
+	err := self.emit_copy(int(self.copy_start), int(self.copy_length))
+	self.copy_length = 0
+	return err
+}
+
+// close_chunks cuts up what is left in the tail at Close
+func (self *RsyncPatchWriter) close_chunks() error {
+	for start := 0; start < len(self.tail); {
+		length := self.sig.chunking.Cut(self.tail[start:])
+		if err := self.emit_chunk(self.tail[start : start+length]); err != nil {
+			return err
+		}
+		start += length
+	}
+	self.tail = self.tail[:0]
+	return self.flush_chunk_copy()
+}
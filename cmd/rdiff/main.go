@@ -0,0 +1,734 @@
+//
+// Copyright 2018 Daniel Reiter Horn
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS
+// OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// rdiff computes and applies signatures and deltas with the same command line
+// interface, file formats and exit codes as librsync's rdiff. Its signatures
+// use the rollsum weak sum with a blake2 strong sum by default, as rdiff 2.0
+// and 2.1 do; the rabinkarp weak sum rdiff 2.2 and later default to isn't
+// supported.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	rsync "github.com/danielrh/go-rsync"
+	"github.com/danielrh/go-rsync/cdc"
+)
+
+// exit codes follow librsync's rs_result values, which rdiff returns directly
+const (
+	exitDone          = 0
+	exitIOError       = 100
+	exitSyntaxError   = 101
+	exitInputEnded    = 103
+	exitBadMagic      = 104
+	exitUnimplemented = 105
+	exitCorrupt       = 106
+	exitParamError    = 108
+)
+
+const usage = `Usage: rdiff [OPTIONS] signature [BASIS [SIGNATURE]]
+             [OPTIONS] delta SIGNATURE [NEWFILE [DELTA]]
+             [OPTIONS] patch BASIS [DELTA [NEWFILE]]
+             [OPTIONS] inspect [SIGNATURE|DELTA [OUTPUT]]
+             [OPTIONS] verify SIGNATURE [FILE [OUTPUT]]
+
+Options:
+  -V, --version             Show program version
+  -?, --help                Show this help message
+  -s, --statistics          Show performance statistics
+  -f, --force               Force overwriting existing files
+  -j, --json                Print inspect and verify output as JSON
+Signature generation options:
+  -H, --hash=ALG            Hash algorithm: blake2 (default), md4, sha256
+  -R, --rollsum=ALG         Rollsum algorithm: rollsum, the only one supported;
+                            rdiff 2.2 and later default to rabinkarp, so sign
+                            with their -R rollsum for signatures this reads
+      --seed                Salt the strong sums with a random seed; rdiff can't
+                            read the resulting signature
+      --extended            Record the basis length, hash and creation time in
+                            an extended header; rdiff can't read it either
+      --chunked             Cut the basis into content-defined chunks averaging
+                            the block size, 8192 bytes by default, and match
+                            whole chunks in delta; implies --extended
+Delta-encoding options:
+  -b, --block-size=BYTES    Signature block size, 0 (default) for recommended
+  -S, --sum-size=BYTES      Set signature strength, 0 (default) for max, -1 for min
+      --sparse              Write zero runs as compact commands and skip holes in
+                            NEWFILE; rdiff can't apply the resulting delta
+      --aligned             Only look for blocks at the offsets they had in the
+                            basis, for files changed in place
+      --append              Check first whether NEWFILE is the basis with data
+                            appended, as logs are, and skip the search if so
+Range options:
+      --offset=BYTES        Sign only the part of BASIS from this offset, or
+                            patch from it; delta takes the signature's range
+                            of NEWFILE
+      --length=BYTES        How long that part is, 0 (default) for the rest of
+                            BASIS; patch needs it whenever --offset is given
+
+Use '-' for stdin or stdout; missing file arguments also mean stdin or stdout.
+Short options combine as in rdiff: -sf is -s -f and -b2048 is -b 2048.
+`
+
+type cliError struct {
+	code int
+	err  error
+}
+
+func (self *cliError) Error() string {
+	return self.err.Error()
+}
+
+func fail(code int, err error) error {
+	return &cliError{code: code, err: err}
+}
+
+type options struct {
+	block_size int
+	sum_size   int
+	hash       string
+	rollsum    string
+	seed       bool
+	extended   bool
+	chunked    bool
+	offset     int64
+	length     int64
+	sparse     bool
+	aligned    bool
+	append     bool
+	statistics bool
+	force      bool
+	json       bool
+	help       bool
+	version    bool
+	// what "-" and missing file arguments stand for
+	stdin  io.Reader
+	stdout io.Writer
+}
+
+func newFlagSet(opts *options) *flag.FlagSet {
+	fs := flag.NewFlagSet("rdiff", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	for _, name := range []string{"b", "block-size"} {
+		fs.IntVar(&opts.block_size, name, 0, "")
+	}
+	for _, name := range []string{"S", "sum-size"} {
+		fs.IntVar(&opts.sum_size, name, 0, "")
+	}
+	for _, name := range []string{"H", "hash"} {
+		fs.StringVar(&opts.hash, name, "blake2", "")
+	}
+	for _, name := range []string{"R", "rollsum"} {
+		fs.StringVar(&opts.rollsum, name, "rollsum", "")
+	}
+	fs.BoolVar(&opts.seed, "seed", false, "")
+	fs.BoolVar(&opts.extended, "extended", false, "")
+	fs.BoolVar(&opts.chunked, "chunked", false, "")
+	fs.Int64Var(&opts.offset, "offset", 0, "")
+	fs.Int64Var(&opts.length, "length", 0, "")
+	fs.BoolVar(&opts.sparse, "sparse", false, "")
+	fs.BoolVar(&opts.aligned, "aligned", false, "")
+	fs.BoolVar(&opts.append, "append", false, "")
+	for _, name := range []string{"s", "statistics"} {
+		fs.BoolVar(&opts.statistics, name, false, "")
+	}
+	for _, name := range []string{"f", "force"} {
+		fs.BoolVar(&opts.force, name, false, "")
+	}
+	for _, name := range []string{"j", "json"} {
+		fs.BoolVar(&opts.json, name, false, "")
+	}
+	for _, name := range []string{"?", "h", "help"} {
+		fs.BoolVar(&opts.help, name, false, "")
+	}
+	for _, name := range []string{"V", "version"} {
+		fs.BoolVar(&opts.version, name, false, "")
+	}
+	return fs
+}
+
+// splitShortOptions rewrites popt style clusters of short options, such as -sf
+// or -b2048, into one argument per option and value. Anything else, including
+// the single dash spellings of long options the flag package accepts, is left
+// alone.
+func splitShortOptions(fs *flag.FlagSet, args []string) []string {
+	var ret []string
+	for index, item := range args {
+		if item == "--" {
+			return append(ret, args[index:]...)
+		}
+		name, _, _ := strings.Cut(strings.TrimPrefix(item, "-"), "=")
+		if len(item) <= 2 || item[0] != '-' || item[1] == '-' || fs.Lookup(name) != nil {
+			ret = append(ret, item)
+			continue
+		}
+		var split []string
+		for pos := 1; pos < len(item); pos++ {
+			option := fs.Lookup(item[pos : pos+1])
+			if option == nil {
+				split = nil
+				break
+			}
+			split = append(split, "-"+item[pos:pos+1])
+			if _, ok := option.Value.(interface{ IsBoolFlag() bool }); !ok {
+				// the rest of the cluster, if any, is the value
+				if pos+1 < len(item) {
+					split = append(split, item[pos+1:])
+				}
+				break
+			}
+		}
+		if split == nil {
+			split = []string{item}
+		}
+		ret = append(ret, split...)
+	}
+	return ret
+}
+
+// parseArgs accepts options before, between and after the positional arguments
+// the way popt does for the C rdiff
+func parseArgs(args []string) (options, []string, error) {
+	var opts options
+	fs := newFlagSet(&opts)
+	args = splitShortOptions(fs, args)
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return opts, nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return opts, positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func openInput(opts *options, name string) (io.ReadCloser, error) {
+	if name == "" || name == "-" {
+		return io.NopCloser(opts.stdin), nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fail(exitIOError, err)
+	}
+	return f, nil
+}
+
+func readInput(opts *options, name string) ([]byte, error) {
+	input, err := openInput(opts, name)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return nil, fail(exitIOError, err)
+	}
+	return data, nil
+}
+
+// mapInput is readInput for signatures and bases, which are memory mapped
+// when they are files. release must be called once the data is unused.
+func mapInput(opts *options, name string) ([]byte, func(), error) {
+	if name == "" || name == "-" {
+		data, err := readInput(opts, name)
+		return data, func() {}, err
+	}
+	mapped, err := rsync.MapFile(name)
+	if err != nil {
+		return nil, nil, fail(exitIOError, err)
+	}
+	return mapped.Bytes(), func() { mapped.Close() }, nil
+}
+
+// countingWriter buffers output, counts it for --statistics and remembers
+// write failures so they can be told apart from corrupt input
+type countingWriter struct {
+	out     *bufio.Writer
+	closer  io.Closer
+	written int64
+	err     error
+}
+
+func (self *countingWriter) Write(data []byte) (int, error) {
+	n, err := self.out.Write(data)
+	self.written += int64(n)
+	if err != nil {
+		self.err = err
+	}
+	return n, err
+}
+
+func (self *countingWriter) finish() error {
+	err := self.out.Flush()
+	if self.closer != nil {
+		if cerr := self.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		return fail(exitIOError, err)
+	}
+	return nil
+}
+
+// classify maps an error coming out of the library onto an rdiff exit code
+func (self *countingWriter) classify(err error) error {
+	if err == nil {
+		return nil
+	}
+	if self.err != nil && errors.Is(err, self.err) {
+		return fail(exitIOError, err)
+	}
+	return corrupt(err)
+}
+
+// corrupt maps an error in a signature or delta onto an rdiff exit code
+func corrupt(err error) error {
+	switch {
+	case errors.Is(err, rsync.ErrBadMagic):
+		return fail(exitBadMagic, err)
+	case errors.Is(err, rsync.ErrInputEnded):
+		return fail(exitInputEnded, err)
+	}
+	return fail(exitCorrupt, err)
+}
+
+func openOutputFile(name string, force bool) (*os.File, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !force {
+		flags |= os.O_EXCL
+	}
+	f, err := os.OpenFile(name, flags, 0666)
+	if err != nil {
+		return nil, fail(exitIOError, err)
+	}
+	return f, nil
+}
+
+func openOutput(opts *options, name string) (*countingWriter, error) {
+	if name == "" || name == "-" {
+		return &countingWriter{out: bufio.NewWriter(opts.stdout)}, nil
+	}
+	f, err := openOutputFile(name, opts.force)
+	if err != nil {
+		return nil, err
+	}
+	return &countingWriter{out: bufio.NewWriter(f), closer: f}, nil
+}
+
+func arg(args []string, index int) string {
+	if index < len(args) {
+		return args[index]
+	}
+	return ""
+}
+
+// sigArgs picks the strong hash, and the block and strong sum sizes the way
+// librsync's rs_sig_args does
+func sigArgs(opts *options, file_size int64) (rsync.StrongHash, uint32, uint32, error) {
+	strong, ok := rsync.LookupStrongHash(opts.hash)
+	if !ok {
+		return nil, 0, 0, fail(exitUnimplemented, fmt.Errorf("hash algorithm %q is not supported", opts.hash))
+	}
+	if opts.rollsum != "rollsum" {
+		return nil, 0, 0, fail(exitUnimplemented, fmt.Errorf("rollsum algorithm %q is not supported, only rollsum", opts.rollsum))
+	}
+	if opts.block_size < 0 {
+		return nil, 0, 0, fail(exitParamError, fmt.Errorf("invalid block size %d", opts.block_size))
+	}
+	block_size, sum_size, err := rsync.RecommendedSigArgsForHash(file_size, uint32(opts.block_size), opts.sum_size, strong)
+	if err != nil {
+		return nil, 0, 0, fail(exitParamError, err)
+	}
+	return strong, block_size, sum_size, nil
+}
+
+func signature(opts *options, args []string) (string, error) {
+	if len(args) > 2 {
+		return "", fail(exitSyntaxError, errors.New("too many arguments for signature"))
+	}
+	// mapped, so that signing a window of a huge basis only reads the window
+	basis, release, err := mapInput(opts, arg(args, 0))
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	var window rsync.Region
+	signed := int64(len(basis))
+	if opts.offset != 0 || opts.length != 0 {
+		window = rsync.Region{Offset: opts.offset, Length: opts.length}
+		if opts.length == 0 {
+			window.Length = int64(len(basis)) - opts.offset
+		}
+		if window.Length <= 0 {
+			return "", fail(exitParamError, fmt.Errorf("nothing to sign from offset %d", opts.offset))
+		}
+		signed = window.Length
+	}
+	strong, block_size, sum_size, err := sigArgs(opts, signed)
+	if err != nil {
+		return "", err
+	}
+	output, err := openOutput(opts, arg(args, 1))
+	if err != nil {
+		return "", err
+	}
+	sig_opts := rsync.SigOptions{Hash: strong, Extended: opts.extended, Window: window}
+	if opts.chunked {
+		sig_opts.Chunking = cdc.NewParams(opts.block_size)
+	}
+	if opts.seed {
+		if sig_opts.Seed, err = rsync.NewSeed(); err != nil {
+			return "", fail(exitIOError, err)
+		}
+	}
+	sig, err := rsync.NewSigFileContext(context.Background(), block_size, basis, sum_size, &sig_opts)
+	if err != nil {
+		return "", fail(exitParamError, err)
+	}
+	if _, err = sig.WriteTo(output); err != nil {
+		return "", output.classify(err)
+	}
+	stats := fmt.Sprintf("signature[%d blocks, %d bytes per block] in-bytes=%d out-bytes=%d",
+		sig.BlockCount(), block_size, signed, output.written)
+	if opts.chunked {
+		stats = fmt.Sprintf("signature[%d chunks, %d bytes average] in-bytes=%d out-bytes=%d",
+			sig.BlockCount(), sig_opts.Chunking.Avg, signed, output.written)
+	}
+	return stats, output.finish()
+}
+
+func delta(opts *options, args []string) (string, error) {
+	if len(args) < 1 {
+		return "", fail(exitSyntaxError, errors.New("delta needs a signature file"))
+	}
+	if len(args) > 3 {
+		return "", fail(exitSyntaxError, errors.New("too many arguments for delta"))
+	}
+	if arg(args, 0) == "-" && (arg(args, 1) == "" || arg(args, 1) == "-") {
+		return "", fail(exitSyntaxError, errors.New("signature and new file can't both be stdin"))
+	}
+	sig, release, err := mapInput(opts, args[0])
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	newFile, err := openInput(opts, arg(args, 1))
+	if err != nil {
+		return "", err
+	}
+	defer newFile.Close()
+	output, err := openOutput(opts, arg(args, 2))
+	if err != nil {
+		return "", err
+	}
+	patchWriter, err := rsync.NewRsyncPatchWriterWithOptions(sig, output,
+		&rsync.DeltaOptions{ZeroRuns: opts.sparse, Aligned: opts.aligned, AppendOnly: opts.append})
+	if err != nil {
+		return "", output.classify(err)
+	}
+	var input io.Reader = newFile
+	if window, ok := patchWriter.Window(); ok {
+		if input, err = window.Section(newFile); err != nil {
+			return "", fail(exitIOError, err)
+		}
+	}
+	_, err = patchWriter.ReadFrom(input)
+	if err != nil {
+		if output.err == nil {
+			return "", fail(exitIOError, err)
+		}
+		return "", output.classify(err)
+	}
+	if err = output.classify(patchWriter.Close()); err != nil {
+		return "", err
+	}
+	stats := fmt.Sprintf("%v out-bytes=%d", patchWriter.Stats(), output.written)
+	return stats, output.finish()
+}
+
+func patch(opts *options, args []string) (string, error) {
+	if len(args) < 1 {
+		return "", fail(exitSyntaxError, errors.New("patch needs a basis file"))
+	}
+	if len(args) > 3 {
+		return "", fail(exitSyntaxError, errors.New("too many arguments for patch"))
+	}
+	if args[0] == "-" {
+		return "", fail(exitSyntaxError, errors.New("basis file must be seekable, not stdin"))
+	}
+	if opts.offset != 0 && opts.length == 0 {
+		return "", fail(exitSyntaxError, errors.New("patch needs the --length of the range at --offset"))
+	}
+	patch_opts := rsync.PatchOptions{BasisWindow: rsync.Region{Offset: opts.offset, Length: opts.length}}
+	deltaData, err := readInput(opts, arg(args, 1))
+	if err != nil {
+		return "", err
+	}
+	if name := arg(args, 2); name != "" && name != "-" {
+		return patchFile(opts, args[0], deltaData, name, &patch_opts)
+	}
+	basis, release, err := mapInput(opts, args[0])
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	output, err := openOutput(opts, arg(args, 2))
+	if err != nil {
+		return "", err
+	}
+	reconstruction, err := rsync.NewPatch(basis, deltaData, &patch_opts)
+	if err != nil {
+		return "", corrupt(err)
+	}
+	if _, err = io.Copy(output, reconstruction); err != nil {
+		return "", output.classify(err)
+	}
+	stats := fmt.Sprintf("in-bytes=%d out-bytes=%d", len(deltaData), output.written)
+	return stats, output.finish()
+}
+
+// patchFile patches from one file to another, letting the kernel do the
+// copies where it can. The delta is checked against the basis first, so any
+// error from the patch itself is an I/O error.
+func patchFile(opts *options, basisName string, deltaData []byte, outputName string, patch_opts *rsync.PatchOptions) (string, error) {
+	basis, err := os.Open(basisName)
+	if err != nil {
+		return "", fail(exitIOError, err)
+	}
+	defer basis.Close()
+	info, err := basis.Stat()
+	if err != nil {
+		return "", fail(exitIOError, err)
+	}
+	basis_size := info.Size()
+	if window := patch_opts.BasisWindow; window.Length != 0 {
+		if window.Offset < 0 || window.Length < 0 || window.End() > basis_size {
+			return "", fail(exitParamError, fmt.Errorf("range %d+%d is outside the %d byte basis",
+				window.Offset, window.Length, basis_size))
+		}
+		basis_size = window.Length
+	}
+	if err = checkDelta(deltaData, basis_size); err != nil {
+		return "", corrupt(err)
+	}
+	output, err := openOutputFile(outputName, opts.force)
+	if err != nil {
+		return "", err
+	}
+	defer output.Close()
+	if err = rsync.ApplyPatchFile(basis, deltaData, output, patch_opts); err != nil {
+		return "", fail(exitIOError, err)
+	}
+	written, err := output.Seek(0, io.SeekCurrent)
+	if err == nil {
+		err = output.Close()
+	}
+	if err != nil {
+		return "", fail(exitIOError, err)
+	}
+	return fmt.Sprintf("in-bytes=%d out-bytes=%d", len(deltaData), written), nil
+}
+
+// checkDelta parses the whole of delta and checks that its copies stay inside
+// a single basis of basis_size bytes, as patching would
+func checkDelta(delta []byte, basis_size int64) error {
+	info, err := rsync.InspectDelta(delta)
+	if err != nil {
+		return err
+	}
+	for _, cmd := range info.Commands {
+		switch {
+		case cmd.Op == "BASIS" && cmd.BasisID != 0:
+			return fmt.Errorf("delta copies from basis %d of 1", cmd.BasisID)
+		case cmd.Op == "COPY" && (cmd.Basis > basis_size || cmd.Length > basis_size-cmd.Basis):
+			return fmt.Errorf("copy of %d bytes at %d is outside the %d byte basis",
+				cmd.Length, cmd.Basis, basis_size)
+		}
+	}
+	return nil
+}
+
+// inspect prints the header and records of a signature, or the command list of
+// a delta, telling the two apart by their magic number
+func inspect(opts *options, args []string) (string, error) {
+	if len(args) > 2 {
+		return "", fail(exitSyntaxError, errors.New("too many arguments for inspect"))
+	}
+	data, err := readInput(opts, arg(args, 0))
+	if err != nil {
+		return "", err
+	}
+	output, err := openOutput(opts, arg(args, 1))
+	if err != nil {
+		return "", err
+	}
+	if bytes.HasPrefix(data, rsync.DeltaMagic) {
+		info, ierr := rsync.InspectDelta(data)
+		if ierr != nil {
+			return "", corrupt(ierr)
+		}
+		if opts.json {
+			err = info.WriteJSON(output)
+		} else {
+			err = info.WriteText(output)
+		}
+	} else {
+		info, ierr := rsync.InspectSignature(data)
+		if ierr != nil {
+			return "", corrupt(ierr)
+		}
+		if opts.json {
+			err = info.WriteJSON(output)
+		} else {
+			err = info.WriteText(output)
+		}
+	}
+	if err != nil {
+		return "", fail(exitIOError, err)
+	}
+	stats := fmt.Sprintf("in-bytes=%d out-bytes=%d", len(data), output.written)
+	return stats, output.finish()
+}
+
+// verify reports the blocks of FILE that no longer match SIGNATURE, failing
+// with exitCorrupt if any don't or the length changed
+func verify(opts *options, args []string) (string, error) {
+	if len(args) < 1 {
+		return "", fail(exitSyntaxError, errors.New("verify needs a signature file"))
+	}
+	if len(args) > 3 {
+		return "", fail(exitSyntaxError, errors.New("too many arguments for verify"))
+	}
+	if args[0] == "-" && (arg(args, 1) == "" || arg(args, 1) == "-") {
+		return "", fail(exitSyntaxError, errors.New("signature and file can't both be stdin"))
+	}
+	sig, err := openInput(opts, args[0])
+	if err != nil {
+		return "", err
+	}
+	defer sig.Close()
+	file, err := openInput(opts, arg(args, 1))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	report, err := rsync.VerifyAgainstSignature(sig, file)
+	if err != nil {
+		var perr *os.PathError
+		if errors.As(err, &perr) {
+			return "", fail(exitIOError, err)
+		}
+		return "", corrupt(err)
+	}
+	output, err := openOutput(opts, arg(args, 2))
+	if err != nil {
+		return "", err
+	}
+	if opts.json {
+		err = report.WriteJSON(output)
+	} else {
+		err = report.WriteText(output)
+	}
+	if err != nil {
+		return "", fail(exitIOError, err)
+	}
+	stats := fmt.Sprintf("in-bytes=%d out-bytes=%d", report.FileLength, output.written)
+	if err = output.finish(); err != nil {
+		return "", err
+	}
+	if !report.OK() {
+		return stats, fail(exitCorrupt, fmt.Errorf("%d of %d blocks changed, length changed: %t",
+			len(report.Mismatches), report.SigBlocks, report.LengthChanged))
+	}
+	return stats, nil
+}
+
+// run is rdiff with the given arguments and standard streams, returning its
+// exit code
+func run(argv []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	opts, args, err := parseArgs(argv)
+	if err != nil {
+		fmt.Fprintf(stderr, "rdiff: %v\n%s", err, usage)
+		return exitSyntaxError
+	}
+	opts.stdin, opts.stdout = stdin, stdout
+	if opts.help {
+		fmt.Fprint(stdout, usage)
+		return exitDone
+	}
+	if opts.version {
+		fmt.Fprintln(stdout, "rdiff (go-rsync)")
+		return exitDone
+	}
+	if len(args) == 0 {
+		fmt.Fprintf(stderr, "rdiff: you must specify an action\n%s", usage)
+		return exitSyntaxError
+	}
+	start := time.Now()
+	var stats string
+	switch args[0] {
+	case "signature":
+		stats, err = signature(&opts, args[1:])
+	case "delta":
+		stats, err = delta(&opts, args[1:])
+	case "patch":
+		stats, err = patch(&opts, args[1:])
+	case "inspect":
+		stats, err = inspect(&opts, args[1:])
+	case "verify":
+		stats, err = verify(&opts, args[1:])
+	default:
+		err = fail(exitSyntaxError, fmt.Errorf("you must specify an action: `signature', `delta', `patch', `inspect' or `verify', not %q", args[0]))
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "rdiff: %v\n", err)
+		var cerr *cliError
+		if errors.As(err, &cerr) {
+			return cerr.code
+		}
+		return exitIOError
+	}
+	if opts.statistics {
+		fmt.Fprintf(stderr, "rdiff: %s statistics: %s elapsed=%v\n",
+			args[0], stats, time.Since(start))
+	}
+	return exitDone
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
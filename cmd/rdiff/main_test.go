@@ -0,0 +1,202 @@
+//
+// Copyright 2018 Daniel Reiter Horn
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS
+// OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	rsync "github.com/danielrh/go-rsync"
+)
+
+// rdiff runs the command with stdin as its standard input, returning its exit
+// code, standard output and standard error
+func rdiff(stdin []byte, argv ...string) (int, []byte, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(argv, bytes.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.Bytes(), stderr.String()
+}
+
+func TestParseArgs(t *testing.T) {
+	for _, test := range []struct {
+		argv       []string
+		positional []string
+		check      func(opts options) bool
+	}{
+		{[]string{"signature"}, []string{"signature"}, func(opts options) bool {
+			return opts.hash == "blake2" && opts.rollsum == "rollsum" && opts.block_size == 0 && !opts.force
+		}},
+		{[]string{"-f", "delta", "sig", "-s", "new", "--", "-"}, []string{"delta", "sig", "new", "-"}, func(opts options) bool {
+			return opts.force && opts.statistics
+		}},
+		{[]string{"--block-size=1024", "-S", "-1", "-H", "md4", "signature", "-", "-"}, []string{"signature", "-", "-"}, func(opts options) bool {
+			return opts.block_size == 1024 && opts.sum_size == -1 && opts.hash == "md4"
+		}},
+		{[]string{"patch", "--offset", "10", "--length=20", "basis"}, []string{"patch", "basis"}, func(opts options) bool {
+			return opts.offset == 10 && opts.length == 20
+		}},
+		{[]string{"--sparse", "--aligned", "--append", "-j", "delta"}, []string{"delta"}, func(opts options) bool {
+			return opts.sparse && opts.aligned && opts.append && opts.json
+		}},
+		// popt style clusters of short options
+		{[]string{"-sf", "delta", "-b2048", "-S8"}, []string{"delta"}, func(opts options) bool {
+			return opts.statistics && opts.force && opts.block_size == 2048 && opts.sum_size == 8
+		}},
+		{[]string{"-fHmd4", "-jb", "512", "signature", "--", "-sf"}, []string{"signature", "-sf"}, func(opts options) bool {
+			return opts.force && opts.hash == "md4" && opts.json && opts.block_size == 512 && !opts.statistics
+		}},
+		{[]string{"-block-size=64", "-S-1", "signature"}, []string{"signature"}, func(opts options) bool {
+			return opts.block_size == 64 && opts.sum_size == -1
+		}},
+	} {
+		opts, positional, err := parseArgs(test.argv)
+		if err != nil {
+			panic(fmt.Sprintf("%q: %v", test.argv, err))
+		}
+		if !reflect.DeepEqual(positional, test.positional) || !test.check(opts) {
+			panic(fmt.Sprintf("%q: parsed as %q %+v", test.argv, positional, opts))
+		}
+	}
+	for _, argv := range [][]string{{"--bogus"}, {"-b", "big"}, {"signature", "--block-size"}, {"-sx"}, {"-fb"}} {
+		if _, _, err := parseArgs(argv); err == nil {
+			panic(fmt.Sprintf("%q accepted", argv))
+		}
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	dir := t.TempDir()
+	name := func(file string) string { return filepath.Join(dir, file) }
+	basis := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(basis)
+	newFile := append(append([]byte{}, basis[:50000]...), "changed"...)
+	if err := os.WriteFile(name("basis"), basis, 0666); err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(name("new"), newFile, 0666); err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(name("short"), basis[:1000], 0666); err != nil {
+		panic(err)
+	}
+	if code, _, stderr := rdiff(nil, "signature", name("basis"), name("sig")); code != exitDone {
+		panic(stderr)
+	}
+	if code, _, stderr := rdiff(nil, "delta", name("sig"), name("new"), name("delta")); code != exitDone {
+		panic(stderr)
+	}
+	corrupt := append(append([]byte{}, rsync.DeltaMagic...), 0xff)
+	truncated := append(append([]byte{}, rsync.DeltaMagic...), rsync.RS_OP_LITERAL_N1, 10, 'a')
+	badMagic := append([]byte{0x72, 0x73, 0x01, 0x47}, make([]byte, 8)...)
+	for _, test := range []struct {
+		argv  []string
+		stdin []byte
+		code  int
+	}{
+		{[]string{}, nil, exitSyntaxError},
+		{[]string{"--help"}, nil, exitDone},
+		{[]string{"-V"}, nil, exitDone},
+		{[]string{"--bogus", "signature"}, nil, exitSyntaxError},
+		{[]string{"frobnicate"}, nil, exitSyntaxError},
+		{[]string{"signature", "a", "b", "c"}, nil, exitSyntaxError},
+		{[]string{"delta"}, nil, exitSyntaxError},
+		{[]string{"delta", "-", "-"}, nil, exitSyntaxError},
+		{[]string{"patch", "-", name("delta")}, nil, exitSyntaxError},
+		{[]string{"patch", "--offset", "10", name("basis"), name("delta")}, nil, exitSyntaxError},
+		{[]string{"signature", name("missing")}, nil, exitIOError},
+		{[]string{"signature", name("basis"), name("sig")}, nil, exitIOError},
+		{[]string{"-H", "sha3", "signature"}, basis, exitUnimplemented},
+		{[]string{"-R", "rabinkarp", "signature"}, basis, exitUnimplemented},
+		{[]string{"-b", "-1", "signature"}, basis, exitParamError},
+		{[]string{"-f", "signature", "-", name("out")}, basis, exitDone},
+		{[]string{"delta", name("basis"), name("new")}, nil, exitBadMagic},
+		{[]string{"delta", "-", name("new")}, badMagic, exitBadMagic},
+		{[]string{"delta", "-", name("new")}, badMagic[:10], exitInputEnded},
+		{[]string{"patch", name("basis"), "-"}, basis, exitBadMagic},
+		{[]string{"patch", name("basis"), "-"}, truncated, exitInputEnded},
+		{[]string{"-f", "patch", name("basis"), "-", name("out")}, truncated, exitInputEnded},
+		{[]string{"patch", name("basis"), "-"}, corrupt, exitCorrupt},
+		{[]string{"-f", "patch", name("basis"), "-", name("out")}, corrupt, exitCorrupt},
+		{[]string{"-f", "patch", name("short"), name("delta"), name("out")}, nil, exitCorrupt},
+		{[]string{"-f", "--offset", "10", "--length", "100000", "patch", name("basis"), name("delta"), name("out")}, nil, exitParamError},
+		{[]string{"-f", "patch", name("basis"), name("delta"), name("out")}, nil, exitDone},
+		{[]string{"inspect"}, []byte("neither a signature nor a delta"), exitBadMagic},
+		{[]string{"inspect"}, truncated, exitInputEnded},
+		{[]string{"verify", name("sig"), name("basis")}, nil, exitDone},
+		{[]string{"verify", name("sig"), name("new")}, nil, exitCorrupt},
+	} {
+		if code, _, stderr := rdiff(test.stdin, test.argv...); code != test.code {
+			panic(fmt.Sprintf("%q exited with %d, not %d: %s", test.argv, code, test.code, stderr))
+		}
+	}
+}
+
+func TestStdio(t *testing.T) {
+	dir := t.TempDir()
+	name := func(file string) string { return filepath.Join(dir, file) }
+	basis := make([]byte, 100000)
+	rand.New(rand.NewSource(2)).Read(basis)
+	newFile := append(append([]byte("prefix"), basis[:60000]...), basis[70000:]...)
+	if err := os.WriteFile(name("basis"), basis, 0666); err != nil {
+		panic(err)
+	}
+	// "-" and missing arguments both mean stdin or stdout
+	for _, argv := range [][]string{{"signature"}, {"signature", "-"}, {"signature", "-", "-"}} {
+		code, sig, stderr := rdiff(basis, argv...)
+		if code != exitDone {
+			panic(fmt.Sprintf("%q: %s", argv, stderr))
+		}
+		if err := os.WriteFile(name("sig"), sig, 0666); err != nil {
+			panic(err)
+		}
+		code, delta, stderr := rdiff(newFile, "delta", name("sig"))
+		if code != exitDone {
+			panic(stderr)
+		}
+		code, patched, stderr := rdiff(delta, "patch", name("basis"), "-", "-")
+		if code != exitDone || !bytes.Equal(patched, newFile) {
+			panic(fmt.Sprintf("%q: patch exited with %d: %s", argv, code, stderr))
+		}
+	}
+	code, delta, _ := rdiff(newFile, "delta", name("sig"), "-")
+	if code != exitDone {
+		panic("delta from stdin failed")
+	}
+	code, _, stderr := rdiff(delta, "-s", "-f", "patch", name("basis"), "-", name("out"))
+	if code != exitDone || !strings.Contains(stderr, "patch statistics") {
+		panic(fmt.Sprintf("patch exited with %d: %s", code, stderr))
+	}
+	if patched, err := os.ReadFile(name("out")); err != nil || !bytes.Equal(patched, newFile) {
+		panic(fmt.Sprintf("patched file differs: %v", err))
+	}
+	code, usage_text, _ := rdiff(nil, "--help")
+	if code != exitDone || !strings.Contains(string(usage_text), "blake2 (default)") {
+		panic("usage not printed to stdout")
+	}
+}
@@ -0,0 +1,202 @@
+//
+// Copyright 2018 Daniel Reiter Horn
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS
+// OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rsync
+
+import (
+	"bytes"
+	"errors"
+)
+
+type BlockRangeKind int
+
+const (
+	BlockUnchanged BlockRangeKind = iota // same contents at the same offset
+	BlockMoved                           // same contents as blocks elsewhere in the old file
+	BlockChanged                         // contents not found in the old file
+)
+
+func (self BlockRangeKind) String() string {
+	switch self {
+	case BlockUnchanged:
+		return "unchanged"
+	case BlockMoved:
+		return "moved"
+	case BlockChanged:
+		return "changed"
+	}
+	return "unknown"
+}
+
+func (self BlockRangeKind) MarshalText() ([]byte, error) {
+	return []byte(self.String()), nil
+}
+
+// BlockRange is a run of Count blocks of the new signature starting at Start.
+// Unchanged and moved runs match the old blocks starting at OldStart; OldStart
+// is -1 for changed runs.
+type BlockRange struct {
+	Kind     BlockRangeKind `json:"kind"`
+	Start    int            `json:"start"`
+	Count    int            `json:"count"`
+	OldStart int            `json:"old_start"`
+}
+
+// SigComparison describes the new signature's blocks in terms of the old one.
+// Estimate is the delta CompareSignatures expects: literals for changed blocks
+// and, as RsyncPatchWriter writes them, a copy per unchanged or moved block,
+// or per run of them for content-defined chunks. Since rolling matching can
+// find data the block grid misses, it is an estimate, usually on the high
+// side.
+type SigComparison struct {
+	Ranges         []BlockRange `json:"ranges"`
+	UnchangedCount int          `json:"unchanged_blocks"`
+	MovedCount     int          `json:"moved_blocks"`
+	ChangedCount   int          `json:"changed_blocks"`
+	Estimate       DeltaStats   `json:"estimate"`
+}
+
+// EstimatedDeltaSize is the estimated delta length, magic and end command included
+func (self *SigComparison) EstimatedDeltaSize() int64 {
+	return int64(len(DeltaMagic)) + self.Estimate.OutBytes() + 1
+}
+
+// CompareSignatures matches the blocks of new_sig against old_sig by their
+// weak and strong sums, wherever they are. Both signatures must share a
+// block size, strong hash, strong sum length and seed. Signatures of
+// content-defined chunks, which must share their chunking, match chunks by
+// length and strong sum; since an edit only changes the chunks around it,
+// comparing them needs no rolling search to find the data it moved.
+func CompareSignatures(old_sig, new_sig *SigFile) (SigComparison, error) {
+	if old_sig.chunking != new_sig.chunking {
+		return SigComparison{}, errors.New("Signatures have different chunking")
+	}
+	if old_sig.block_size != new_sig.block_size {
+		return SigComparison{}, errors.New("Signatures have different block sizes")
+	}
+	if old_sig.crypto_hash_size != new_sig.crypto_hash_size || old_sig.Hash() != new_sig.Hash() {
+		return SigComparison{}, errors.New("Signatures have different strong sums")
+	}
+	if !bytes.Equal(old_sig.seed, new_sig.seed) {
+		return SigComparison{}, errors.New("Signatures have different seeds")
+	}
+	var old_index func(sig Sig) []int
+	if old_sig.chunked() {
+		by_sum := make(map[string][]int, len(old_sig.signatures))
+		for index, item := range old_sig.signatures {
+			by_sum[string(item.crypto_hash)] = append(by_sum[string(item.crypto_hash)], index)
+		}
+		old_index = func(sig Sig) []int {
+			var ret []int
+			for _, index := range by_sum[string(sig.crypto_hash)] {
+				if old_sig.signatures[index].length == sig.length {
+					ret = append(ret, index)
+				}
+			}
+			return ret
+		}
+	} else {
+		hint := old_sig.create_sig_hint()
+		old_index = func(sig Sig) []int {
+			var ret []int
+			for _, index := range hint.crc32_to_sig_index[sig.crc32] {
+				if bytes.Equal(old_sig.signatures[index].crypto_hash, sig.crypto_hash) {
+					ret = append(ret, index)
+				}
+			}
+			return ret
+		}
+	}
+	old_offsets, new_offsets := old_sig.offsets(), new_sig.offsets()
+	ret := SigComparison{
+		Ranges: []BlockRange{},
+		Estimate: DeltaStats{
+			SigBlocks: len(old_sig.signatures),
+			BlockSize: old_sig.block_size,
+			InBytes:   new_offsets[len(new_sig.signatures)],
+		},
+	}
+	for index, item := range new_sig.signatures {
+		current := BlockRange{Kind: BlockChanged, Start: index, Count: 1, OldStart: -1}
+		matches := old_index(item)
+		if len(matches) != 0 {
+			current.Kind = BlockMoved
+			current.OldStart = matches[0]
+		}
+		for _, match := range matches {
+			if old_offsets[match] == new_offsets[index] {
+				current.Kind = BlockUnchanged
+				current.OldStart = match
+				break
+			}
+		}
+		if count := len(ret.Ranges); count != 0 {
+			last := &ret.Ranges[count-1]
+			// a moved run keeps going as long as some match continues it
+			if last.Kind == BlockMoved && current.Kind == BlockMoved {
+				for _, match := range matches {
+					if match == last.OldStart+last.Count {
+						current.OldStart = match
+					}
+				}
+			}
+			if last.Kind == current.Kind &&
+				(current.Kind == BlockChanged || current.OldStart == last.OldStart+last.Count) {
+				last.Count += 1
+				continue
+			}
+		}
+		ret.Ranges = append(ret.Ranges, current)
+	}
+	for _, item := range ret.Ranges {
+		length := new_offsets[item.Start+item.Count] - new_offsets[item.Start]
+		switch item.Kind {
+		case BlockChanged:
+			ret.ChangedCount += item.Count
+			for remaining := length; remaining > 0; remaining -= DEFAULT_MAX_LITERAL_RUN {
+				run := min(int(remaining), DEFAULT_MAX_LITERAL_RUN)
+				ret.Estimate.LiteralCmds += 1
+				ret.Estimate.LiteralBytes += int64(run)
+				ret.Estimate.LiteralCmdBytes += int64(len(select_insert_command(run)))
+			}
+			continue
+		case BlockUnchanged:
+			ret.UnchangedCount += item.Count
+		case BlockMoved:
+			ret.MovedCount += item.Count
+		}
+		if new_sig.chunked() {
+			// adjacent chunks are copied together
+			ret.Estimate.CopyCmds += 1
+			ret.Estimate.CopyBytes += length
+			ret.Estimate.CopyCmdBytes += int64(len(select_copy_command(int(old_offsets[item.OldStart]), int(length))))
+			continue
+		}
+		for index := 0; index < item.Count; index++ {
+			length := new_offsets[item.Start+index+1] - new_offsets[item.Start+index]
+			ret.Estimate.CopyCmds += 1
+			ret.Estimate.CopyBytes += length
+			ret.Estimate.CopyCmdBytes += int64(len(select_copy_command(int(old_offsets[item.OldStart+index]), int(length))))
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,301 @@
+//
+// Copyright 2018 Daniel Reiter Horn
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS
+// OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+)
+
+// DEFAULT_HIERARCHY_BLOCK_SIZES are the levels of HierarchicalDelta, coarse to fine
+var DEFAULT_HIERARCHY_BLOCK_SIZES = []uint32{64 * 1024, 8 * 1024, 1024, 256}
+
+// HIERARCHY_REQUEST_SIZE is what asking for the signature of a region costs:
+// its offset and length
+const HIERARCHY_REQUEST_SIZE = 16
+
+// HierarchyOptions tunes HierarchicalDelta. The zero value uses
+// DEFAULT_HIERARCHY_BLOCK_SIZES and 8 bytes of MD4 per block.
+type HierarchyOptions struct {
+	BlockSizes   []uint32 // coarse to fine
+	Hash         StrongHash
+	StrongLength uint32
+
+	// CompareFlat also signs the whole basis at the finest block size and
+	// computes the delta against that, for the report's Flat fields. It about
+	// doubles the work.
+	CompareFlat bool
+}
+
+// HierarchyLevel is the traffic of one round of HierarchicalDelta
+type HierarchyLevel struct {
+	BlockSize    uint32 `json:"block_size"`
+	Regions      int    `json:"regions"`       // basis regions signed
+	RequestBytes int64  `json:"request_bytes"` // asking for them, free for the first level
+	SigBytes     int64  `json:"sig_bytes"`
+	Unmatched    int64  `json:"unmatched_bytes"` // new file bytes still unmatched after the level
+}
+
+// HierarchyReport is what HierarchicalDelta exchanged, next to what a single
+// signature of the whole basis at the finest block size and the delta against
+// it would have cost when HierarchyOptions.CompareFlat is set
+type HierarchyReport struct {
+	Levels         []HierarchyLevel `json:"levels"`
+	Delta          DeltaStats       `json:"delta"`
+	DeltaBytes     int64            `json:"delta_bytes"`
+	TotalBytes     int64            `json:"total_bytes"` // requests, signatures and delta
+	FlatSigBytes   int64            `json:"flat_sig_bytes,omitempty"`
+	FlatDeltaBytes int64            `json:"flat_delta_bytes,omitempty"`
+}
+
+func (self *HierarchyReport) FlatTotalBytes() int64 {
+	return self.FlatSigBytes + self.FlatDeltaBytes
+}
+
+type hierarchySpanKind int
+
+const (
+	spanPending hierarchySpanKind = iota // to be matched against a signature of basis
+	spanCopy                             // a copy of the basis from where
+	spanLiteral                          // sent as is
+)
+
+// hierarchySpan is a stretch of the new file from start to end
+type hierarchySpan struct {
+	kind  hierarchySpanKind
+	start int64
+	end   int64
+	where int64
+	basis Region
+}
+
+// HierarchicalDelta plays both ends of a multi-resolution sync in process and
+// returns the delta from old_file to new_file along with what was exchanged.
+// The side with old_file signs it at the coarsest block size. The side with
+// new_file matches against that, and for every stretch left unmatched asks
+// for a signature, one level finer, of the basis region between the matches
+// on either side of it, down to the finest level; whatever still doesn't
+// match is sent as literals. For files with few changes the coarse signature
+// is small and the finer ones only cover the changes, while the delta comes
+// close to what the finest signature of the whole basis gives.
+func HierarchicalDelta(ctx context.Context, old_file, new_file []byte, opts *HierarchyOptions) ([]byte, HierarchyReport, error) {
+	if opts == nil {
+		opts = &HierarchyOptions{}
+	}
+	block_sizes := opts.BlockSizes
+	if len(block_sizes) == 0 {
+		block_sizes = DEFAULT_HIERARCHY_BLOCK_SIZES
+	}
+	strong_length := opts.StrongLength
+	if strong_length == 0 {
+		strong_length = 8
+	}
+	sig_opts := SigOptions{Hash: opts.Hash}
+	var report HierarchyReport
+	spans := []hierarchySpan{{
+		kind:  spanPending,
+		end:   int64(len(new_file)),
+		basis: Region{Length: int64(len(old_file))},
+	}}
+	for level, block_size := range block_sizes {
+		item := HierarchyLevel{BlockSize: block_size}
+		var next []hierarchySpan
+		for _, span := range spans {
+			if span.kind == spanPending && span.basis.Length == 0 {
+				span.kind = spanLiteral
+			}
+			if span.kind != spanPending {
+				next = append(next, span)
+				continue
+			}
+			sig, err := NewSigFileRegion(ctx, block_size, old_file, span.basis, strong_length, &sig_opts)
+			if err != nil {
+				return nil, report, err
+			}
+			var sig_disk bytes.Buffer
+			if _, err = sig.WriteTo(&sig_disk); err != nil {
+				return nil, report, err
+			}
+			item.Regions += 1
+			item.SigBytes += int64(sig_disk.Len())
+			if level != 0 {
+				item.RequestBytes += HIERARCHY_REQUEST_SIZE
+			}
+			matched, err := matchSpan(ctx, sig_disk.Bytes(), new_file, span)
+			if err != nil {
+				return nil, report, err
+			}
+			next = append(next, matched...)
+		}
+		spans = next
+		for _, span := range spans {
+			if span.kind != spanCopy {
+				item.Unmatched += span.end - span.start
+			}
+		}
+		report.Levels = append(report.Levels, item)
+		report.TotalBytes += item.RequestBytes + item.SigBytes
+	}
+
+	var delta bytes.Buffer
+	delta.Write(DeltaMagic[:])
+	encoder := RsyncPatchWriter{
+		output:          &delta,
+		max_literal_run: DEFAULT_MAX_LITERAL_RUN,
+	}
+	for index := 0; index < len(spans); index++ {
+		span := spans[index]
+		if span.kind != spanCopy {
+			if err := encoder.emit_literals(new_file[span.start:span.end]); err != nil {
+				return nil, report, err
+			}
+			continue
+		}
+		// copies that continue each other in the basis become one
+		for index+1 < len(spans) && spans[index+1].kind == spanCopy &&
+			spans[index+1].where == span.where+span.end-span.start {
+			span.end = spans[index+1].end
+			index += 1
+		}
+		if err := encoder.flush_literals(nil, false); err != nil {
+			return nil, report, err
+		}
+		if err := encoder.emit_copy(int(span.where), int(span.end-span.start)); err != nil {
+			return nil, report, err
+		}
+	}
+	if err := encoder.flush_literals(nil, true); err != nil {
+		return nil, report, err
+	}
+	report.Delta = encoder.stats
+	report.Delta.InBytes = int64(len(new_file))
+	report.DeltaBytes = int64(delta.Len())
+	report.TotalBytes += report.DeltaBytes
+	if !opts.CompareFlat {
+		return delta.Bytes(), report, nil
+	}
+
+	finest := block_sizes[len(block_sizes)-1]
+	flat_sig, err := NewSigFileContext(ctx, finest, old_file, strong_length, &sig_opts)
+	if err != nil {
+		return nil, report, err
+	}
+	var flat_sig_disk bytes.Buffer
+	if report.FlatSigBytes, err = flat_sig.WriteTo(&flat_sig_disk); err != nil {
+		return nil, report, err
+	}
+	flat_delta, err := matchDelta(ctx, flat_sig_disk.Bytes(), new_file, nil)
+	if err != nil {
+		return nil, report, err
+	}
+	report.FlatDeltaBytes = int64(len(flat_delta))
+	return delta.Bytes(), report, nil
+}
+
+// matchDelta is the delta of input against an on-disk signature
+func matchDelta(ctx context.Context, sig []byte, input []byte, opts *DeltaOptions) ([]byte, error) {
+	var delta bytes.Buffer
+	writer, err := NewRsyncPatchWriterWithOptions(sig, &delta, opts)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = writer.WriteContext(ctx, input); err != nil {
+		return nil, err
+	}
+	if err = writer.CloseContext(ctx); err != nil {
+		return nil, err
+	}
+	return delta.Bytes(), nil
+}
+
+// matchSpan matches a pending span against sig, the signature of its basis
+// region, and splits it into copies and the unmatched stretches between them,
+// each of which is pending on the basis between the copies around it
+func matchSpan(ctx context.Context, sig []byte, new_file []byte, span hierarchySpan) ([]hierarchySpan, error) {
+	patch, err := matchDelta(ctx, sig, new_file[span.start:span.end], &DeltaOptions{BasisOffset: span.basis.Offset})
+	if err != nil {
+		return nil, err
+	}
+	var ret []hierarchySpan
+	target := span.start
+	for index := len(DeltaMagic); ; {
+		cmd, next, err := readDeltaCommand(patch, index)
+		if err != nil {
+			return nil, err
+		}
+		index = next
+		if cmd.op == RS_OP_END {
+			break
+		}
+		item := hierarchySpan{kind: spanCopy, start: target, end: target + int64(cmd.length), where: int64(cmd.where)}
+		if cmd.op <= RS_OP_LITERAL_N8 {
+			index += cmd.length
+			item.kind = spanPending
+			if count := len(ret); count != 0 && ret[count-1].kind == spanPending {
+				ret[count-1].end = item.end
+				target = item.end
+				continue
+			}
+		}
+		ret = append(ret, item)
+		target = item.end
+	}
+	for index := range ret {
+		if ret[index].kind != spanPending {
+			continue
+		}
+		start, end := span.basis.Offset, span.basis.End()
+		if index > 0 {
+			start = ret[index-1].where + ret[index-1].end - ret[index-1].start
+		}
+		if index+1 < len(ret) {
+			end = ret[index+1].where
+		}
+		// data that moved leaves no region between its neighbours
+		ret[index].basis = Region{Offset: start, Length: max(end-start, 0)}
+	}
+	return ret, nil
+}
+
+func (self *HierarchyReport) WriteText(output io.Writer) error {
+	for level, item := range self.Levels {
+		_, err := fmt.Fprintf(output, "level %d block_size=%d regions=%d request_bytes=%d sig_bytes=%d unmatched_bytes=%d\n",
+			level, item.BlockSize, item.Regions, item.RequestBytes, item.SigBytes, item.Unmatched)
+		if err != nil {
+			return err
+		}
+	}
+	if self.FlatSigBytes == 0 {
+		_, err := fmt.Fprintf(output, "total_bytes=%d delta_bytes=%d\n", self.TotalBytes, self.DeltaBytes)
+		return err
+	}
+	_, err := fmt.Fprintf(output, "total_bytes=%d delta_bytes=%d flat_total_bytes=%d flat_sig_bytes=%d flat_delta_bytes=%d\n",
+		self.TotalBytes, self.DeltaBytes, self.FlatTotalBytes(), self.FlatSigBytes, self.FlatDeltaBytes)
+	return err
+}
+
+func (self *HierarchyReport) WriteJSON(output io.Writer) error {
+	return writeJSON(output, self)
+}
@@ -0,0 +1,309 @@
+//
+// Copyright 2018 Daniel Reiter Horn
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS
+// OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rsync
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/danielrh/go-rsync/cdc"
+)
+
+// SigBlockInfo describes one block record of a signature. Records of
+// content-defined chunks have a Length and no Weak sum.
+type SigBlockInfo struct {
+	Index  int    `json:"index"`
+	Offset int64  `json:"offset"`
+	Length uint32 `json:"length,omitempty"`
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+// SigInfo is a dump of a signature's header and block records
+type SigInfo struct {
+	Magic        string         `json:"magic"`
+	Hash         string         `json:"hash"`
+	BlockSize    uint32         `json:"block_size"`
+	StrongLength uint32         `json:"strong_length"`
+	Seed         string         `json:"seed,omitempty"`
+	Chunking     *cdc.Params    `json:"chunking,omitempty"`
+	Window       *Region        `json:"window,omitempty"`
+	BlockCount   int            `json:"block_count"`
+	Header       *SigHeaderInfo `json:"header,omitempty"`
+	Blocks       []SigBlockInfo `json:"blocks"`
+}
+
+// SigHeaderInfo is the file level metadata of an extended signature
+type SigHeaderInfo struct {
+	BasisLength  int64             `json:"basis_length"`
+	FileHashAlgo string            `json:"file_hash_algo,omitempty"`
+	FileHash     string            `json:"file_hash,omitempty"`
+	Created      string            `json:"created,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+// DeltaCommandInfo describes one command of a delta. Offset is where the
+// command starts in the delta itself and Target where its output lands in the
+// reconstructed file. Basis is only meaningful for copies, and BasisID for
+// the basis commands of multi-basis deltas; the JSON leaves each out of the
+// other commands.
+type DeltaCommandInfo struct {
+	Op      string `json:"op"`
+	Opcode  byte   `json:"opcode"`
+	Offset  int64  `json:"offset"`
+	Target  int64  `json:"target"`
+	Basis   int64  `json:"basis"`
+	BasisID int    `json:"basis_id"`
+	Length  int64  `json:"length"`
+}
+
+func (self DeltaCommandInfo) MarshalJSON() ([]byte, error) {
+	item := struct {
+		Op      string `json:"op"`
+		Opcode  byte   `json:"opcode"`
+		Offset  int64  `json:"offset"`
+		Target  int64  `json:"target"`
+		Basis   *int64 `json:"basis,omitempty"`
+		BasisID *int   `json:"basis_id,omitempty"`
+		Length  int64  `json:"length"`
+	}{Op: self.Op, Opcode: self.Opcode, Offset: self.Offset, Target: self.Target, Length: self.Length}
+	switch self.Op {
+	case "COPY":
+		item.Basis = &self.Basis
+	case "BASIS":
+		item.BasisID = &self.BasisID
+	}
+	return json.Marshal(item)
+}
+
+// DeltaInfo is a dump of a delta's command list along with a few totals
+type DeltaInfo struct {
+	Magic        string             `json:"magic"`
+	LiteralBytes int64              `json:"literal_bytes"`
+	CopyBytes    int64              `json:"copy_bytes"`
+	ZeroBytes    int64              `json:"zero_bytes,omitempty"`
+	Commands     []DeltaCommandInfo `json:"commands"`
+}
+
+func (self *SigFile) Info() SigInfo {
+	magic := self.magic()
+	info := SigInfo{
+		Magic:        "0x" + hex.EncodeToString(magic[:]),
+		Hash:         self.Hash().Name(),
+		BlockSize:    self.block_size,
+		StrongLength: self.crypto_hash_size,
+		Seed:         hex.EncodeToString(self.seed),
+		BlockCount:   len(self.signatures),
+		Blocks:       make([]SigBlockInfo, len(self.signatures)),
+	}
+	if header, ok := self.Header(); ok {
+		info.Header = &SigHeaderInfo{
+			BasisLength: header.BasisLength,
+			FileHash:    hex.EncodeToString(header.FileHash),
+			Metadata:    header.Metadata,
+		}
+		if header.FileHashAlgo != nil {
+			info.Header.FileHashAlgo = header.FileHashAlgo.Name()
+		}
+		if !header.Created.IsZero() {
+			info.Header.Created = header.Created.UTC().Format(time.RFC3339Nano)
+		}
+	}
+	if self.chunked() {
+		chunking := self.chunking
+		info.Chunking = &chunking
+	}
+	if window, ok := self.Window(); ok {
+		info.Window = &window
+	}
+	offsets := self.offsets()
+	for index, item := range self.signatures {
+		info.Blocks[index] = SigBlockInfo{
+			Index:  index,
+			Offset: offsets[index],
+			Length: item.length,
+			Weak:   item.crc32,
+			Strong: hex.EncodeToString(item.crypto_hash),
+		}
+	}
+	return info
+}
+
+// InspectSignature decodes an on-disk signature with DeserializeSigFileView
+func InspectSignature(on_disk_format []byte) (SigInfo, error) {
+	sig, err := DeserializeSigFileView(on_disk_format)
+	if err != nil {
+		return SigInfo{}, err
+	}
+	return sig.Info(), nil
+}
+
+// InspectDelta walks every command of a delta without needing the basis
+func InspectDelta(patch []byte) (DeltaInfo, error) {
+	if err := checkDeltaMagic(patch); err != nil {
+		return DeltaInfo{}, err
+	}
+	info := DeltaInfo{Magic: "0x" + hex.EncodeToString(DeltaMagic)}
+	index := len(DeltaMagic)
+	var target int64
+	for index < len(patch) {
+		cmd, next, err := readDeltaCommand(patch, index)
+		if err != nil {
+			return info, err
+		}
+		item := DeltaCommandInfo{
+			Opcode: cmd.op,
+			Offset: int64(index),
+			Target: target,
+			Length: int64(cmd.length),
+		}
+		index = next
+		switch {
+		case cmd.op == RS_OP_END:
+			item.Op = "END"
+			info.Commands = append(info.Commands, item)
+			return info, nil
+		case cmd.op <= RS_OP_LITERAL_N8:
+			if cmd.length > len(patch)-index {
+				return info, ErrInputEnded
+			}
+			index += cmd.length
+			item.Op = "LITERAL"
+			info.LiteralBytes += item.Length
+		case isZeroRun(cmd.op):
+			item.Op = "ZERO"
+			info.ZeroBytes += item.Length
+		case isBasisCommand(cmd.op):
+			item.Op = "BASIS"
+			item.BasisID = cmd.where
+		default:
+			item.Op = "COPY"
+			item.Basis = int64(cmd.where)
+			info.CopyBytes += item.Length
+		}
+		target += item.Length
+		info.Commands = append(info.Commands, item)
+	}
+	return info, ErrInputEnded
+}
+
+func (self *SigInfo) WriteText(output io.Writer) error {
+	_, err := fmt.Fprintf(output, "signature magic=%s hash=%s block_size=%d strong_length=%d blocks=%d\n",
+		self.Magic, self.Hash, self.BlockSize, self.StrongLength, self.BlockCount)
+	if err != nil {
+		return err
+	}
+	if self.Seed != "" {
+		if _, err = fmt.Fprintf(output, "seed %s\n", self.Seed); err != nil {
+			return err
+		}
+	}
+	if window := self.Window; window != nil {
+		if _, err = fmt.Fprintf(output, "window offset=%d length=%d\n", window.Offset, window.Length); err != nil {
+			return err
+		}
+	}
+	if chunking := self.Chunking; chunking != nil {
+		_, err = fmt.Fprintf(output, "chunking min=%d avg=%d max=%d\n", chunking.Min, chunking.Avg, chunking.Max)
+		if err != nil {
+			return err
+		}
+	}
+	if header := self.Header; header != nil {
+		_, err = fmt.Fprintf(output, "header basis_length=%d file_hash=%s:%s created=%s\n",
+			header.BasisLength, header.FileHashAlgo, header.FileHash, header.Created)
+		if err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(header.Metadata))
+		for key := range header.Metadata {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if _, err = fmt.Fprintf(output, "metadata %q=%q\n", key, header.Metadata[key]); err != nil {
+				return err
+			}
+		}
+	}
+	for _, block := range self.Blocks {
+		if self.Chunking != nil {
+			_, err = fmt.Fprintf(output, "chunk %d offset=%d length=%d strong=%s\n",
+				block.Index, block.Offset, block.Length, block.Strong)
+		} else {
+			_, err = fmt.Fprintf(output, "block %d offset=%d weak=0x%08x strong=%s\n",
+				block.Index, block.Offset, block.Weak, block.Strong)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *DeltaInfo) WriteText(output io.Writer) error {
+	_, err := fmt.Fprintf(output, "delta magic=%s commands=%d literal_bytes=%d copy_bytes=%d\n",
+		self.Magic, len(self.Commands), self.LiteralBytes, self.CopyBytes)
+	if err != nil {
+		return err
+	}
+	for _, cmd := range self.Commands {
+		switch cmd.Op {
+		case "COPY":
+			_, err = fmt.Fprintf(output, "%d\t0x%02x COPY    target=%d basis=%d length=%d\n",
+				cmd.Offset, cmd.Opcode, cmd.Target, cmd.Basis, cmd.Length)
+		case "LITERAL":
+			_, err = fmt.Fprintf(output, "%d\t0x%02x LITERAL target=%d length=%d\n",
+				cmd.Offset, cmd.Opcode, cmd.Target, cmd.Length)
+		case "ZERO":
+			_, err = fmt.Fprintf(output, "%d\t0x%02x ZERO    target=%d length=%d\n",
+				cmd.Offset, cmd.Opcode, cmd.Target, cmd.Length)
+		case "BASIS":
+			_, err = fmt.Fprintf(output, "%d\t0x%02x BASIS   id=%d\n", cmd.Offset, cmd.Opcode, cmd.BasisID)
+		default:
+			_, err = fmt.Fprintf(output, "%d\t0x%02x %s\n", cmd.Offset, cmd.Opcode, cmd.Op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *SigInfo) WriteJSON(output io.Writer) error {
+	return writeJSON(output, self)
+}
+
+func (self *DeltaInfo) WriteJSON(output io.Writer) error {
+	return writeJSON(output, self)
+}
+
+func writeJSON(output io.Writer, value interface{}) error {
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
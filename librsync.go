@@ -24,8 +24,10 @@ package rsync
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 )
 
@@ -59,9 +61,32 @@ const RS_OP_COPY_N8_N4 = byte(0x53)
 */
 const RS_OP_COPY_N8_N8 = byte(0x54)
 
+// The zero run commands are not librsync's, which reserves these opcodes.
+// They write a run of zero bytes whose length follows in 1, 2, 4 or 8 bytes,
+// and are only emitted when DeltaOptions.ZeroRuns asks for them.
+const RS_OP_ZERO_N1 = byte(0x55)
+const RS_OP_ZERO_N2 = byte(0x56)
+const RS_OP_ZERO_N4 = byte(0x57)
+const RS_OP_ZERO_N8 = byte(0x58)
+
+// The basis commands aren't librsync's either. A multi-basis delta uses them
+// to pick, by its index in the list given to ApplyPatchMulti, the basis that
+// the copies after them read from; copies before the first read from basis 0.
+// The index follows in 1, 2, 4 or 8 bytes.
+const RS_OP_BASIS_N1 = byte(0x59)
+const RS_OP_BASIS_N2 = byte(0x5a)
+const RS_OP_BASIS_N4 = byte(0x5b)
+const RS_OP_BASIS_N8 = byte(0x5c)
+
 var DeltaMagic = []byte{0x72, 0x73, 0x02, 0x36}
 
-var earlyEOF = errors.New("Early End of File")
+// ErrBadMagic is wrapped by the errors for signatures and deltas that don't
+// start with a magic number this package reads
+var ErrBadMagic = errors.New("Bad magic number")
+
+// ErrInputEnded is wrapped by the errors for signatures and deltas that end
+// part way through a header, record or command
+var ErrInputEnded = errors.New("Early End of File")
 
 func beRead(data []byte) int {
 	var retval uint64
@@ -72,61 +97,376 @@ func beRead(data []byte) int {
 	return int(retval)
 }
 
-func ApplyPatch(base []byte, patch []byte, output io.Writer) error {
-	var index int
+// PatchOptions bounds the work a delta may cause while it is being applied and
+// optionally reports progress. A zero limit means the corresponding resource is
+// unlimited.
+type PatchOptions struct {
+	MaxOutputBytes   int64 // total bytes written to the output
+	MaxCommands      int64 // number of literal and copy commands
+	MaxCommandLength int64 // bytes produced by any single command
+
+	Progress         ProgressFunc
+	ProgressInterval int64 // delta bytes between Progress calls, DEFAULT_PROGRESS_INTERVAL if 0
+
+	// BasisWindow, unless its Length is 0, is the range of the basis that the
+	// delta's copies count from and may not leave: the window of the
+	// signature the delta was made against, see SigOptions.Window. The output
+	// is the new contents of the window.
+	BasisWindow Region
+}
+
+type PatchLimit int
+
+const (
+	LimitOutputBytes PatchLimit = iota
+	LimitCommands
+	LimitCommandLength
+)
+
+func (self PatchLimit) String() string {
+	switch self {
+	case LimitOutputBytes:
+		return "output bytes"
+	case LimitCommands:
+		return "command count"
+	case LimitCommandLength:
+		return "command length"
+	}
+	return "unknown limit"
+}
+
+// PatchLimitError is returned by ApplyPatchWithOptions when a delta would exceed
+// one of the configured PatchOptions limits. Nothing past the limit is written.
+type PatchLimitError struct {
+	Limit PatchLimit
+	Max   int64
+	Value int64 // the value the delta asked for
+}
+
+func (self *PatchLimitError) Error() string {
+	return fmt.Sprintf("Patch exceeds %v limit: %d > %d", self.Limit, self.Value, self.Max)
+}
+
+// deltaCommand is a single decoded opcode of a delta stream
+type deltaCommand struct {
+	op     byte
+	where  int // basis offset of a copy, or the index a basis command picks
+	length int // bytes the command produces
+}
+
+// readDeltaCommand decodes the opcode and arguments found at patch[index:] and
+// returns the index just past them. Literal payloads are left for the caller.
+func readDeltaCommand(patch []byte, index int) (deltaCommand, int, error) {
+	if index >= len(patch) {
+		return deltaCommand{}, index, ErrInputEnded
+	}
+	cmd := deltaCommand{op: patch[index]}
+	index += 1
+	if cmd.op == RS_OP_END {
+		return cmd, index, nil
+	}
+	if cmd.op <= RS_OP_LITERAL_N8 {
+		cmd.length = int(cmd.op)
+		if cmd.op >= RS_OP_LITERAL_N1 {
+			beLiteralsToRead := 1 << (cmd.op - RS_OP_LITERAL_N1)
+			if index+beLiteralsToRead > len(patch) {
+				return cmd, index, ErrInputEnded
+			}
+			cmd.length = beRead(patch[index : index+beLiteralsToRead])
+			index += beLiteralsToRead
+		}
+	} else if cmd.op > RS_OP_BASIS_N8 {
+		return cmd, index, errors.New("Reserved command: 0x" + hex.EncodeToString([]byte{cmd.op}))
+	} else if cmd.op >= RS_OP_BASIS_N1 {
+		idNumBytes := 1 << (cmd.op - RS_OP_BASIS_N1)
+		if index+idNumBytes > len(patch) {
+			return cmd, index, ErrInputEnded
+		}
+		cmd.where = beRead(patch[index : index+idNumBytes])
+		index += idNumBytes
+		if cmd.where < 0 {
+			return cmd, index, errors.New("Basis index overflows")
+		}
+	} else if cmd.op >= RS_OP_ZERO_N1 {
+		lenNumBytes := 1 << (cmd.op - RS_OP_ZERO_N1)
+		if index+lenNumBytes > len(patch) {
+			return cmd, index, ErrInputEnded
+		}
+		cmd.length = beRead(patch[index : index+lenNumBytes])
+		index += lenNumBytes
+	} else { // we are in copy territory
+		copyLenIndex := cmd.op - RS_OP_COPY_N1_N1
+		lower2bits := copyLenIndex & 0x3
+		upper2bits := copyLenIndex >> 2
+		whereNumBytes := 1 << upper2bits
+		lenNumBytes := 1 << lower2bits
+		if index+whereNumBytes+lenNumBytes > len(patch) {
+			return cmd, index, ErrInputEnded
+		}
+		cmd.where = beRead(patch[index : index+whereNumBytes])
+		index += whereNumBytes
+		cmd.length = beRead(patch[index : index+lenNumBytes])
+		index += lenNumBytes
+		if cmd.where < 0 {
+			return cmd, index, errors.New("Copy offset overflows")
+		}
+	}
+	if cmd.length < 0 {
+		return cmd, index, errors.New("Command length overflows")
+	}
+	return cmd, index, nil
+}
+
+func checkDeltaMagic(patch []byte) error {
 	if len(patch) < len(DeltaMagic) {
-		return errors.New("Too short 0x" + hex.EncodeToString(patch))
+		return fmt.Errorf("Too short 0x%s: %w", hex.EncodeToString(patch), ErrInputEnded)
 	}
 	if !bytes.Equal(patch[:len(DeltaMagic)], DeltaMagic) {
-		return errors.New("Bad magic number 0x" +
-			hex.EncodeToString(patch[:len(DeltaMagic)]) +
-			" != 0x" + hex.EncodeToString(DeltaMagic))
-	}
-	index += len(DeltaMagic)
-	for index < len(patch) {
-		cmd := patch[index]
-		index += 1
-		if cmd == RS_OP_END {
+		return fmt.Errorf("%w 0x%s != 0x%s", ErrBadMagic,
+			hex.EncodeToString(patch[:len(DeltaMagic)]), hex.EncodeToString(DeltaMagic))
+	}
+	return nil
+}
+
+func ApplyPatch(base []byte, patch []byte, output io.Writer) error {
+	return ApplyPatchWithOptions(base, patch, output, nil)
+}
+
+// ApplyPatchWithOptions behaves like ApplyPatch but refuses, with a
+// *PatchLimitError, any command that would take the patch past a limit in opts.
+// opts may be nil.
+func ApplyPatchWithOptions(base []byte, patch []byte, output io.Writer, opts *PatchOptions) error {
+	return ApplyPatchContext(context.Background(), base, patch, output, opts)
+}
+
+// cancelChunkSize bounds how much a single output write may carry while a
+// cancellable patch is being applied
+const cancelChunkSize = 1 << 20
+
+// writeChunked writes data in pieces, checking done before each one
+func writeChunked(ctx context.Context, output io.Writer, data []byte) error {
+	for len(data) != 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		chunk := data[:min(len(data), cancelChunkSize)]
+		if _, err := output.Write(chunk); err != nil {
+			return err
+		}
+		data = data[len(chunk):]
+	}
+	return nil
+}
+
+// ApplyPatchContext is ApplyPatchWithOptions checking ctx before every command
+// and every megabyte of output. On cancellation it returns ctx.Err() and the
+// output holds a prefix of the reconstructed file.
+func ApplyPatchContext(ctx context.Context, base []byte, patch []byte, output io.Writer, opts *PatchOptions) error {
+	reader, err := NewPatch(base, patch, opts)
+	if err != nil {
+		return err
+	}
+	for {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		data, err := reader.next()
+		if err == io.EOF {
 			return nil
 		}
-		if cmd <= RS_OP_LITERAL_N8 {
-			numLiterals := int(cmd)
-			if cmd >= RS_OP_LITERAL_N1 {
-				beLiteralsToRead := 1 << (cmd - RS_OP_LITERAL_N1)
-				if index+beLiteralsToRead > len(patch) {
-					return earlyEOF
-				}
-				numLiterals = beRead(patch[index : index+beLiteralsToRead])
-				index += beLiteralsToRead
-			}
-			if index+numLiterals > len(patch) {
-				return earlyEOF
-			}
-			_, werr := output.Write(patch[index : index+numLiterals])
-			index += numLiterals
-			if werr != nil {
-				return werr
+		if err != nil {
+			return err
+		}
+		if ctx.Done() != nil {
+			err = writeChunked(ctx, output, data)
+		} else {
+			_, err = output.Write(data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Patch is the file a delta reconstructs from its basis. It is an io.Reader
+// and an io.WriterTo, so io.Copy streams it without an intermediate buffer.
+type Patch struct {
+	base         []byte
+	base_size    int
+	delta        []byte
+	limits       PatchOptions
+	index        int
+	pending      []byte // output of the current command not yet returned by Read
+	zeros        int    // bytes of the current zero run not yet returned by next
+	num_commands int64
+	output_bytes int64
+	progress     progressTracker
+	err          error         // sticky, io.EOF once the end command has been reached
+	bases        []io.ReaderAt // set by ApplyPatchMulti, whose copies check their own bounds
+	basis        int           // index of the basis copies read from
+}
+
+func NewPatch(base []byte, delta []byte, opts *PatchOptions) (*Patch, error) {
+	if err := checkDeltaMagic(delta); err != nil {
+		return nil, err
+	}
+	ret := &Patch{
+		base:      base,
+		base_size: len(base),
+		delta:     delta,
+		index:     len(DeltaMagic),
+	}
+	if opts != nil {
+		ret.limits = *opts
+	}
+	if window := ret.limits.BasisWindow; window.Length != 0 && base != nil {
+		if err := window.check(int64(len(base))); err != nil {
+			return nil, err
+		}
+		ret.base = base[window.Offset:window.End()]
+		ret.base_size = len(ret.base)
+	}
+	ret.progress = newProgressTracker(ret.limits.Progress, ret.limits.ProgressInterval, PhasePatch, int64(len(delta)))
+	ret.progress.add(int64(ret.index))
+	return ret, nil
+}
+
+// next decodes one command and returns the bytes it produces, which alias
+// the basis or the delta. It returns io.EOF after the end command.
+func (self *Patch) next() ([]byte, error) {
+	if self.err != nil {
+		return nil, self.err
+	}
+	if self.zeros != 0 {
+		chunk := zeroChunk[:min(self.zeros, len(zeroChunk))]
+		self.zeros -= len(chunk)
+		return chunk, nil
+	}
+	data, err := self.decode()
+	if err != nil {
+		self.err = err
+	}
+	return data, err
+}
+
+func (self *Patch) decode() ([]byte, error) {
+	cmd, data, err := self.command()
+	if err != nil || data != nil {
+		return data, err
+	}
+	if isZeroRun(cmd.op) {
+		chunk := zeroChunk[:min(cmd.length, len(zeroChunk))]
+		self.zeros = cmd.length - len(chunk)
+		return chunk, nil
+	}
+	return self.base[cmd.where : cmd.where+cmd.length], nil
+}
+
+// zeroChunk is the source of zero runs' output; nothing may write to it
+var zeroChunk = make([]byte, 64*1024)
+
+func isZeroRun(op byte) bool {
+	return op >= RS_OP_ZERO_N1 && op <= RS_OP_ZERO_N8
+}
+
+func isBasisCommand(op byte) bool {
+	return op >= RS_OP_BASIS_N1 && op <= RS_OP_BASIS_N8
+}
+
+// command decodes the next command that produces output, checking it against
+// the limits and the basis size. It returns the payload of a literal and nil
+// for a copy or zero run, leaving the caller to produce their output.
+func (self *Patch) command() (deltaCommand, []byte, error) {
+	for self.index < len(self.delta) {
+		cmd, next, err := readDeltaCommand(self.delta, self.index)
+		if err != nil {
+			return cmd, nil, err
+		}
+		self.progress.add(int64(next - self.index))
+		self.index = next
+		if cmd.op == RS_OP_END {
+			self.progress.finish()
+			return cmd, nil, io.EOF
+		}
+		if isBasisCommand(cmd.op) {
+			if cmd.where >= max(len(self.bases), 1) {
+				return cmd, nil, fmt.Errorf("Delta copies from basis %d of %d", cmd.where, max(len(self.bases), 1))
 			}
-		} else if cmd > RS_OP_COPY_N8_N8 {
-			return errors.New("Reserved command: 0x" + hex.EncodeToString([]byte{cmd}))
-		} else { // we are in copy territory
-			copyLenIndex := cmd - RS_OP_COPY_N1_N1
-			lower2bits := copyLenIndex & 0x3
-			upper2bits := copyLenIndex >> 2
-			whereNumBytes := 1 << upper2bits
-			lenNumBytes := 1 << lower2bits
-			if index+whereNumBytes+lenNumBytes > len(patch) {
-				return earlyEOF
+			self.basis = cmd.where
+			continue
+		}
+		self.num_commands += 1
+		limits := &self.limits
+		if limits.MaxCommands != 0 && self.num_commands > limits.MaxCommands {
+			return cmd, nil, &PatchLimitError{Limit: LimitCommands, Max: limits.MaxCommands, Value: self.num_commands}
+		}
+		if limits.MaxCommandLength != 0 && int64(cmd.length) > limits.MaxCommandLength {
+			return cmd, nil, &PatchLimitError{Limit: LimitCommandLength, Max: limits.MaxCommandLength, Value: int64(cmd.length)}
+		}
+		if limits.MaxOutputBytes != 0 && self.output_bytes+int64(cmd.length) > limits.MaxOutputBytes {
+			return cmd, nil, &PatchLimitError{Limit: LimitOutputBytes, Max: limits.MaxOutputBytes,
+				Value: self.output_bytes + int64(cmd.length)}
+		}
+		self.output_bytes += int64(cmd.length)
+		if cmd.length == 0 {
+			continue
+		}
+		if cmd.op <= RS_OP_LITERAL_N8 {
+			if cmd.length > len(self.delta)-self.index {
+				return cmd, nil, ErrInputEnded
 			}
-			where := beRead(patch[index : index+whereNumBytes])
-			index += whereNumBytes
-			numBytes := beRead(patch[index : index+lenNumBytes])
-			index += lenNumBytes
-			_, werr := output.Write(base[where : where+numBytes])
-			if werr != nil {
-				return werr
+			data := self.delta[self.index : self.index+cmd.length]
+			self.index += cmd.length
+			self.progress.add(int64(cmd.length))
+			return cmd, data, nil
+		}
+		if isZeroRun(cmd.op) {
+			return cmd, nil, nil
+		}
+		if self.bases == nil && (cmd.where > self.base_size || cmd.length > self.base_size-cmd.where) {
+			return cmd, nil, fmt.Errorf("Copy of %d bytes at %d is outside the %d byte basis",
+				cmd.length, cmd.where, self.base_size)
+		}
+		return cmd, nil, nil
+	}
+	return deltaCommand{}, nil, ErrInputEnded
+}
+
+func (self *Patch) Read(data []byte) (int, error) {
+	for len(self.pending) == 0 {
+		var err error
+		self.pending, err = self.next()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(data, self.pending)
+	self.pending = self.pending[n:]
+	return n, nil
+}
+
+// WriteTo writes the rest of the reconstructed file to output. Reaching the
+// end of the delta is not an error.
+func (self *Patch) WriteTo(output io.Writer) (int64, error) {
+	var written int64
+	for {
+		if len(self.pending) != 0 {
+			n, err := output.Write(self.pending)
+			written += int64(n)
+			self.pending = self.pending[n:]
+			if err != nil {
+				return written, err
 			}
 		}
+		var err error
+		self.pending, err = self.next()
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
 	}
-	return earlyEOF
 }
@@ -23,32 +23,42 @@ package rsync
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"os"
+	"hash"
+	"math"
+	"time"
 
 	"io"
+	"os"
 
-	"golang.org/x/crypto/md4"
+	"github.com/danielrh/go-rsync/cdc"
+	"github.com/danielrh/go-rsync/rollsum"
 )
 
 type Sig struct {
 	crc32       uint32
+	length      uint32 // chunk length of content-defined signatures, which have no weak sum
 	crypto_hash []byte
 }
 
 type SigFileStat struct {
 	file_size  int
 	block_size uint32
-	blake5     bool
+	hash       StrongHash
 }
 
 type SigFile struct {
 	block_size       uint32
 	signatures       []Sig
 	crypto_hash_size uint32
-	blake5           bool
+	hash             StrongHash
+	seed             []byte
+	header           *SigHeader // nil unless the extended header carries one
+	chunking         cdc.Params // zero unless the blocks are content-defined chunks
+	window           *Region    // the range of the basis signed, if not all of it
 }
 
 func be_to_u32(data []byte) uint32 {
@@ -76,26 +86,218 @@ func min(a, b int) int {
 	}
 	return a
 }
+func min64(a, b int64) int64 {
+	if a > b {
+		return b
+	}
+	return a
+}
+
+// SigOptions tunes NewSigFileWithOptions. The zero value matches NewSigFile.
+type SigOptions struct {
+	Progress         ProgressFunc
+	ProgressInterval int64 // bytes between Progress calls, DEFAULT_PROGRESS_INTERVAL if 0
+
+	// Hash is the strong checksum, MD4 if nil. Only MD4 and BLAKE2 signatures
+	// can be read by rdiff.
+	Hash StrongHash
+
+	// Seed, if set, is hashed ahead of every block so that whoever writes the
+	// new file can't craft strong sum collisions without knowing it. It is
+	// kept in the signature's extended header; see NewSeed.
+	Seed []byte
+
+	// Extended writes the extended header with the basis length, a hash of
+	// the whole basis and the creation time, Created or else now. Metadata is
+	// stored alongside and implies Extended. rdiff can't read these.
+	Extended bool
+	Created  time.Time
+	Metadata map[string]string
+
+	// Chunking, if set, cuts the basis into content-defined chunks with
+	// FastCDC rather than blocks of block_size, which is ignored. The records
+	// hold each chunk's length and strong sum, and deltas against them match
+	// whole chunks by strong sum with no rolling search. Such signatures are
+	// extended; see cdc.NewParams.
+	Chunking cdc.Params
+
+	// Window, unless its Length is 0, signs that range of buf alone and
+	// records it in the extended header. Deltas against the signature copy
+	// from offsets within the window, and are applied with the same window
+	// as PatchOptions.BasisWindow, so a range of a huge file can be synced
+	// without signing the rest. SigHeader.BasisLength is the window's.
+	Window Region
+}
+
 func NewSigFile(block_size uint32, buf []byte, crypto_sig_size uint32) SigFile {
-	num_signatures := (len(buf) + int(block_size) - 1) / int(block_size)
-	sig := make([]Sig, num_signatures)
-	for index, item := range sig {
-		slice := buf[index*int(block_size) : min((index+1)*int(block_size), len(buf))]
-		md4_hasher := md4.New()
-		_, _ = md4_hasher.Write(slice)
-		sig[index] = Sig{
-			crypto_hash: md4_hasher.Sum(nil)[:crypto_sig_size],
-			crc32:       crcUpdate(item.crc32, slice),
-		}
-	}
-	return SigFile{
+	return NewSigFileWithOptions(block_size, buf, crypto_sig_size, nil)
+}
+
+// NewSigFileWithOptions panics on arguments NewSigFileContext rejects, rather
+// than returning a signature of nothing
+func NewSigFileWithOptions(block_size uint32, buf []byte, crypto_sig_size uint32, opts *SigOptions) SigFile {
+	sig, err := NewSigFileContext(context.Background(), block_size, buf, crypto_sig_size, opts)
+	if err != nil {
+		panic(err)
+	}
+	return sig
+}
+
+// NewSigFileContext is NewSigFileWithOptions checking ctx between blocks; once
+// ctx is done it stops and returns ctx.Err() with an empty SigFile.
+func NewSigFileContext(ctx context.Context, block_size uint32, buf []byte, crypto_sig_size uint32, opts *SigOptions) (SigFile, error) {
+	if opts == nil {
+		opts = &SigOptions{}
+	}
+	strong := opts.Hash
+	if strong == nil {
+		strong = MD4
+	}
+	if int(crypto_sig_size) > strong.Size() {
+		return SigFile{}, fmt.Errorf("Strong sum size %d is longer than the %d byte %s sum",
+			crypto_sig_size, strong.Size(), strong.Name())
+	}
+	ret := SigFile{
 		block_size:       block_size,
-		signatures:       sig,
-		blake5:           false,
 		crypto_hash_size: crypto_sig_size,
+		hash:             strong,
+		seed:             append([]byte(nil), opts.Seed...),
 	}
+	if opts.Window.Length != 0 {
+		if err := opts.Window.check(int64(len(buf))); err != nil {
+			return SigFile{}, err
+		}
+		buf = buf[opts.Window.Offset:opts.Window.End()]
+		window := opts.Window
+		ret.window = &window
+	}
+	// block_end returns where the block starting at offset ends
+	block_end := func(offset int) int {
+		return min(offset+int(block_size), len(buf))
+	}
+	if opts.Chunking != (cdc.Params{}) {
+		if err := opts.Chunking.Validate(); err != nil {
+			return SigFile{}, err
+		}
+		ret.chunking = opts.Chunking
+		ret.block_size = uint32(opts.Chunking.Avg)
+		block_end = func(offset int) int {
+			return offset + ret.chunking.Cut(buf[offset:])
+		}
+	} else if block_size == 0 {
+		return SigFile{}, errors.New("Block size must be positive")
+	}
+	var file_hasher hash.Hash
+	if opts.Extended || len(opts.Metadata) != 0 {
+		ret.header = &SigHeader{
+			BasisLength:  int64(len(buf)),
+			FileHashAlgo: strong,
+			Created:      opts.Created,
+			Metadata:     make(map[string]string, len(opts.Metadata)),
+		}
+		if ret.header.Created.IsZero() {
+			ret.header.Created = time.Now()
+		}
+		for key, value := range opts.Metadata {
+			ret.header.Metadata[key] = value
+		}
+		file_hasher = strong.New()
+	}
+	progress := newProgressTracker(opts.Progress, opts.ProgressInterval, PhaseSignature, int64(len(buf)))
+	hasher := ret.newHasher()
+	digest := make([]byte, 0, strong.Size())
+	var zero_sig *Sig // shared by every all-zero block, computed on the first
+	sig := make([]Sig, 0, (len(buf)+int(ret.block_size)-1)/int(ret.block_size))
+	done := ctx.Done()
+	for offset := 0; offset < len(buf); offset = block_end(offset) {
+		if done != nil {
+			select {
+			case <-done:
+				return SigFile{}, ctx.Err()
+			default:
+			}
+		}
+		slice := buf[offset:block_end(offset)]
+		if file_hasher != nil {
+			_, _ = file_hasher.Write(slice)
+		}
+		if !ret.chunked() && len(slice) == int(block_size) && isZero(slice) {
+			if zero_sig == nil {
+				zero := ret.zeroBlockSig()
+				zero_sig = &zero
+			}
+			sig = append(sig, *zero_sig)
+			progress.add(int64(len(slice)))
+			continue
+		}
+		hasher.Reset()
+		_, _ = hasher.Write(slice)
+		record := Sig{
+			crypto_hash: append([]byte(nil), hasher.Sum(digest[:0])[:crypto_sig_size]...),
+		}
+		if ret.chunked() {
+			record.length = uint32(len(slice))
+		} else {
+			record.crc32 = rollsum.Checksum(slice)
+		}
+		sig = append(sig, record)
+		progress.add(int64(len(slice)))
+	}
+	progress.finish()
+	if file_hasher != nil {
+		ret.header.FileHash = file_hasher.Sum(nil)
+	}
+	ret.signatures = sig
+	return ret, nil
+}
+
+const DEFAULT_BLOCK_SIZE = 2048
+const MD4_SUM_SIZE = 16
+
+func log2(val int64) int64 {
+	var ret int64
+	for val >>= 1; val != 0; val >>= 1 {
+		ret += 1
+	}
+	return ret
+}
+
+// RecommendedSigArgs fills in the block size and strong sum size for a basis of
+// file_size bytes (negative if unknown) the way librsync's rs_sig_args does.
+// A block_size of 0 picks sqrt(file_size) rounded down to a multiple of 128, a
+// crypto_sig_size of 0 the full MD4 sum, and -1 the smallest safe truncation.
+func RecommendedSigArgs(file_size int64, block_size uint32, crypto_sig_size int) (uint32, uint32, error) {
+	return RecommendedSigArgsForHash(file_size, block_size, crypto_sig_size, MD4)
 }
 
+// RecommendedSigArgsForHash is RecommendedSigArgs for signatures using strong,
+// whose digest size is the default and the limit for crypto_sig_size.
+func RecommendedSigArgsForHash(file_size int64, block_size uint32, crypto_sig_size int, strong StrongHash) (uint32, uint32, error) {
+	if block_size == 0 {
+		if file_size < 0 {
+			block_size = DEFAULT_BLOCK_SIZE
+		} else if file_size <= 256*256 {
+			block_size = 256
+		} else {
+			block_size = uint32(math.Sqrt(float64(file_size))) &^ 127
+		}
+	}
+	min_sig_size := 2 + (log2(file_size+(1<<24))+log2(file_size/int64(block_size)+1)+7)/8
+	switch {
+	case crypto_sig_size == 0:
+		crypto_sig_size = strong.Size()
+	case crypto_sig_size == -1:
+		crypto_sig_size = min(int(min_sig_size), strong.Size())
+	case crypto_sig_size < -1 || crypto_sig_size > strong.Size():
+		return 0, 0, fmt.Errorf("Invalid strong sum size %d", crypto_sig_size)
+	}
+	return block_size, uint32(crypto_sig_size), nil
+}
+
+// Deprecated: the weak sum is librsync's rollsum, see rollsum.CharOffset
+const CRC_MAGIC_16 uint16 = rollsum.CharOffset
+const CRC_MAGIC uint32 = rollsum.CharOffset
+
 const HEADER_SIZE = 12
 
 var MD4_MAGIC = [4]byte{0x72, 0x73, 0x01, 0x36}
@@ -103,80 +305,133 @@ var BLAKE5_MAGIC = [4]byte{0x72, 0x73, 0x01, 0x37}
 
 func DeserializeSigFileView(on_disk_format []byte) (SigFile, error) { // don't reuse this buffer
 	if len(on_disk_format) < 12 {
-		return SigFile{}, errors.New("File too short " + hex.EncodeToString(on_disk_format))
+		return SigFile{}, fmt.Errorf("File too short %s: %w", hex.EncodeToString(on_disk_format), ErrInputEnded)
 	}
-	//fmt.Fprintf(os.Stderr, "File is ok %d\n", len(on_disk_format))
-	var is_md4 = bytes.Equal(MD4_MAGIC[:], on_disk_format[:4])
-	var is_blake5 = bytes.Equal(BLAKE5_MAGIC[:], on_disk_format[:4])
-	if !(is_md4 || is_blake5) {
-		return SigFile{}, errors.New("File sig not recognized " + hex.EncodeToString(on_disk_format[:4]))
+	ret, header_size, err := readSigHeader(on_disk_format)
+	if err != nil {
+		return SigFile{}, err
+	}
+	strong := ret.Hash()
+	var desired_crypto_hash_size = ret.crypto_hash_size
+	if desired_crypto_hash_size > uint32(strong.Size()) {
+		return SigFile{}, fmt.Errorf("Strong sum size %d is longer than the %d byte %s sum",
+			desired_crypto_hash_size, strong.Size(), strong.Name())
 	}
-	var desired_crypto_hash_size = be_to_u32(on_disk_format[8:HEADER_SIZE])
 	var stride = 4 + int(desired_crypto_hash_size)
-	if (len(on_disk_format)-HEADER_SIZE)%stride != 0 {
-		return SigFile{}, errors.New("File not a multiple of stride bytes")
+	if (len(on_disk_format)-header_size)%stride != 0 {
+		return SigFile{}, fmt.Errorf("File not a multiple of stride bytes: %w", ErrInputEnded)
 	}
-	numRecords := (len(on_disk_format) - HEADER_SIZE) / stride
-	//fmt.Fprintf(os.Stderr, "File has %d records (stride %d)\n", numRecords, stride)
+	numRecords := (len(on_disk_format) - header_size) / stride
 	var sigs = make([]Sig, numRecords)
 	for index, _ := range sigs {
-		var record_start = on_disk_format[index*stride+HEADER_SIZE:]
+		var record_start = on_disk_format[index*stride+header_size:]
 		sigs[index] = Sig{
 			crypto_hash: record_start[4 : 4+int(desired_crypto_hash_size)],
-			crc32:       be_to_u32(record_start),
+		}
+		if ret.chunked() {
+			sigs[index].length = be_to_u32(record_start)
+		} else {
+			sigs[index].crc32 = be_to_u32(record_start)
 		}
 	}
-	return SigFile{
-		block_size:       be_to_u32(on_disk_format[4:8]),
-		signatures:       sigs,
-		crypto_hash_size: desired_crypto_hash_size,
-		blake5:           is_blake5,
-	}, nil
+	ret.signatures = sigs
+	return ret, nil
 
 }
 
 type SigHint struct {
 	crc32_to_sig_index map[uint32][]int
+	// filter is a one-hash bloom filter over the weak sums that lets most
+	// windows be rejected without a map lookup
+	filter       []uint64
+	filter_shift uint32
+}
+
+func (self *SigHint) filter_bit(crc32 uint32) uint32 {
+	return (crc32 * 0x9e3779b1) >> self.filter_shift
+}
+
+func (self *SigHint) may_contain(crc32 uint32) bool {
+	bit := self.filter_bit(crc32)
+	return self.filter[bit>>6]&(1<<(bit&63)) != 0
+}
+
+func (self *SigFile) magic() [4]byte {
+	if self.extended() {
+		return EXTENDED_SIG_MAGIC
+	}
+	return self.Hash().Magic()
+}
+
+// Hash is the strong checksum the signature was built with
+func (self *SigFile) Hash() StrongHash {
+	if self.hash == nil {
+		return MD4
+	}
+	return self.hash
+}
+
+// BlockCount is the number of block records, one per chunk if the signature is
+// content-defined
+func (self *SigFile) BlockCount() int {
+	return len(self.signatures)
 }
 
 func (self *SigFile) Serialize(output io.Writer) error {
-	var headerBuffer [12]byte
-	if self.blake5 {
-		copy(headerBuffer[:4], BLAKE5_MAGIC[:])
-	} else {
-		copy(headerBuffer[:4], MD4_MAGIC[:])
-	}
-	var le_buffer [4]byte
-	le_buffer = u32_to_be(self.block_size)
-	copy(headerBuffer[4:8], le_buffer[:])
-	le_buffer = u32_to_be(self.crypto_hash_size)
-	copy(headerBuffer[8:12], le_buffer[:])
-	_, err := output.Write(headerBuffer[:])
+	_, err := self.WriteTo(output)
 	if err != nil {
 		return err
 	}
-	sigBuffer := make([]byte, 4+self.crypto_hash_size)
-	for _, sig := range self.signatures {
-		le_buffer = u32_to_be(sig.crc32)
-		copy(sigBuffer[:4], le_buffer[:])
-		copy(sigBuffer[4:], sig.crypto_hash)
-		_, err = output.Write(sigBuffer)
-		if err != nil {
-			return err
-		}
-	}
 	if closer, ok := output.(io.WriteCloser); ok {
 		return closer.Close()
 	}
 	return nil
 }
 
+// sigWriteChunk is roughly how much WriteTo hands to each output.Write call
+const sigWriteChunk = 64 * 1024
+
+// WriteTo writes the signature in the on-disk format. Unlike Serialize it
+// leaves output open.
+func (self *SigFile) WriteTo(output io.Writer) (int64, error) {
+	var written int64
+	buffer := make([]byte, 0, sigWriteChunk+HEADER_SIZE)
+	buffer = self.appendHeader(buffer)
+	for _, sig := range self.signatures {
+		le_buffer := u32_to_be(sig.crc32)
+		if self.chunked() {
+			le_buffer = u32_to_be(sig.length)
+		}
+		buffer = append(buffer, le_buffer[:]...)
+		buffer = append(buffer, sig.crypto_hash[:self.crypto_hash_size]...)
+		if len(buffer) >= sigWriteChunk {
+			n, err := output.Write(buffer)
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+			buffer = buffer[:0]
+		}
+	}
+	n, err := output.Write(buffer)
+	written += int64(n)
+	return written, err
+}
+
 func (self *SigFile) create_sig_hint() SigHint {
 	var hint = SigHint{
 		crc32_to_sig_index: make(map[uint32][]int, len(self.signatures)),
+		filter_shift:       32 - 16,
 	}
+	// keep the filter at least 16 bits per block so it stays sparse
+	for hint.filter_shift > 6 && (1<<(32-hint.filter_shift)) < 16*len(self.signatures) {
+		hint.filter_shift -= 1
+	}
+	hint.filter = make([]uint64, 1<<(32-hint.filter_shift-6))
 	for index, item := range self.signatures {
 		hint.crc32_to_sig_index[item.crc32] = append(hint.crc32_to_sig_index[item.crc32], index)
+		bit := hint.filter_bit(item.crc32)
+		hint.filter[bit>>6] |= 1 << (bit & 63)
 	}
 	return hint
 }
@@ -184,28 +439,222 @@ func (self *SigFile) create_sig_hint() SigHint {
 type RsyncPatchWriter struct {
 	sig              SigFile
 	hint             SigHint
-	buffer           []byte
-	ring_buffer_ptr  int
-	buffer_fill      int
+	matcher          blockMatcher
+	tail             []byte // input past the last tested window, always shorter than a block or a maximum chunk
 	output           io.Writer
-	crc32            uint32
 	pending_literals []byte
+	stats            DeltaStats
+	progress         progressTracker
+	err              error // sticky once a context has cancelled the delta
+	max_literal_run  int
+	zero_runs        bool
+	zero_blocks      []bool // signature blocks that are all zero, if zero_runs
+	pending_zeros    int    // zero bytes owed to the output as a zero run
+	aligned          bool
+	roll_after_miss  int64
+	roll_until       int64 // input offset up to which an aligned writer rolls after a miss
+	grid             int64 // input offset modulo the block size of an aligned writer's windows
+	buf_offset       int64 // input offset of the buffer being consumed
+	append_state     appendState
+	prefix_blocks    int         // signature blocks matched in order by the append-only path
+	chunks           *chunkIndex // set for content-defined signatures
+	copy_start       int64       // basis offset of the copy of adjacent chunks being built
+	copy_length      int64
+	basis_offset     int         // added to every copy's basis offset
+	bases            []basisSpan // where each basis' blocks sit in a multi-basis signature
+	current_basis    int         // the basis copies read from, in a multi-basis delta
+}
+
+// DeltaOptions tunes NewRsyncPatchWriterWithOptions. The zero value matches
+// NewRsyncPatchWriter.
+type DeltaOptions struct {
+	Progress         ProgressFunc
+	ProgressInterval int64 // bytes between Progress calls, DEFAULT_PROGRESS_INTERVAL if 0
+	InputSize        int64 // size of the new file if known, reported as Progress.Total
+
+	// MaxLiteralRun caps how many unmatched bytes are held before they are
+	// written out as a literal command, DEFAULT_MAX_LITERAL_RUN if 0. It bounds
+	// the writer's memory and lets the delta stream while it is computed.
+	MaxLiteralRun int
+
+	// Parallelism and SegmentSize only apply to WriteDeltaParallel: how many
+	// segments are scanned at once (GOMAXPROCS if 0) and how long each one is
+	// (DEFAULT_SEGMENT_SIZE if 0).
+	Parallelism int
+	SegmentSize int64
+
+	// ZeroRuns writes runs of zeros, whether unmatched or copies of all-zero
+	// blocks, as zero run commands, and skips reading the holes of sparse
+	// files handed to ReadFrom. Only this package's patchers understand zero
+	// runs; librsync treats them as reserved opcodes.
+	ZeroRuns bool
+
+	// Aligned only tests the windows at multiples of the block size, which
+	// loses nothing on files changed in place. It saves the rolling search
+	// through blocks that changed, so it pays off with many rewritten blocks,
+	// running about twice as fast as rolling when half of them are; with few
+	// edits both skip from match to match at about the same speed (see
+	// BenchmarkDeltaAligned). After a window misses, the next RollAfterMiss
+	// bytes are scanned at every offset to pick up data that moved, and a
+	// match there shifts the grid to follow it; 0 never rolls.
+	// WriteDeltaParallel ignores both.
+	Aligned       bool
+	RollAfterMiss int
+
+	// AppendOnly suits files that only grow. While the input matches the
+	// signature's blocks in order no search is done; if it matches the whole
+	// basis the delta is one copy of it and a literal tail. At the first block
+	// that doesn't match, the blocks that did are copied and the normal search
+	// takes over from there. WriteDeltaParallel ignores it.
+	AppendOnly bool
+
+	// BasisOffset is added to the offset of every copy. It scopes a delta to
+	// a signature of one region of the basis, see NewSigFileRegion, while the
+	// delta still applies to the whole basis.
+	BasisOffset int64
+
+	// A signature of content-defined chunks is matched chunk by chunk, which
+	// has nothing for Aligned, RollAfterMiss, AppendOnly or the parallel
+	// scan of WriteDeltaParallel to speed up; they are ignored.
+}
+
+const DEFAULT_MAX_LITERAL_RUN = 1 << 16
+
+// blockMatcher finds the signature block, if any, that a window of the new
+// file duplicates. It keeps one strong hasher for the life of the delta.
+type blockMatcher struct {
+	sig    *SigFile
+	hint   *SigHint
+	hasher hash.Hash
+	digest []byte
+	stats  *DeltaStats
+}
+
+func newBlockMatcher(sig *SigFile, hint *SigHint, stats *DeltaStats) blockMatcher {
+	return blockMatcher{
+		sig:    sig,
+		hint:   hint,
+		hasher: sig.newHasher(),
+		digest: make([]byte, 0, sig.Hash().Size()),
+		stats:  stats,
+	}
+}
+
+// lookup returns the index of the block whose weak sum and strong hash agree
+// with window, or -1. Windows shorter than a block are only compared with the
+// final block, the one place a short block can occur.
+func (self *blockMatcher) lookup(sum uint32, window []byte) int {
+	if !self.hint.may_contain(sum) {
+		return -1
+	}
+	matchLocations, ok := self.hint.crc32_to_sig_index[sum]
+	if !ok {
+		return -1
+	}
+	self.stats.WeakHits += 1
+	self.hasher.Reset()
+	_, _ = self.hasher.Write(window)
+	hash := self.hasher.Sum(self.digest[:0])
+	last := len(self.sig.signatures) - 1
+	for _, match := range matchLocations {
+		if len(window) != int(self.sig.block_size) && match != last {
+			continue
+		}
+		sigInstance := self.sig.signatures[match]
+		if bytes.Equal(hash[:len(sigInstance.crypto_hash)], sigInstance.crypto_hash) {
+			return match
+		}
+	}
+	self.stats.FalseMatches += 1
+	return -1
+}
+
+// scan rolls a block sized window over buf from pos, where sum is the weak sum
+// of buf[pos:pos+block_size], testing each window that starts before limit.
+// It returns the first matching window's position and block, or limit and -1
+// along with the weak sum of the window at limit if buf holds all of it.
+func (self *blockMatcher) scan(buf []byte, pos int, limit int, sum uint32) (int, int, uint32) {
+	block_size := int(self.sig.block_size)
+	size_16 := uint16(block_size)
+	filter := self.hint.filter
+	shift := self.hint.filter_shift
+	// this is rollsum.Rollsum.Roll by hand; keeping both halves in locals is
+	// worth well over half the throughput of this loop
+	s1 := uint16(sum & 0xffff)
+	s2 := uint16(sum >> 16)
+	for ; pos < limit; pos++ {
+		sum = uint32(s1) | (uint32(s2) << 16)
+		bit := (sum * 0x9e3779b1) >> shift
+		if filter[bit>>6]&(1<<(bit&63)) != 0 {
+			if match := self.lookup(sum, buf[pos:pos+block_size]); match >= 0 {
+				return pos, match, sum
+			}
+		}
+		if pos+block_size < len(buf) {
+			old_byte := uint16(buf[pos])
+			s1 = s1 + (uint16(buf[pos+block_size]) - old_byte)
+			s2 = s2 + (s1 - size_16*(old_byte+rollsum.CharOffset))
+		}
+	}
+	return pos, -1, uint32(s1) | (uint32(s2) << 16)
 }
 
 func NewRsyncPatchWriter(sig []byte, output io.Writer) (*RsyncPatchWriter, error) {
-	var ret RsyncPatchWriter
-	var err error
-	ret.sig, err = DeserializeSigFileView(sig)
+	return NewRsyncPatchWriterWithOptions(sig, output, nil)
+}
+
+func NewRsyncPatchWriterWithOptions(sig []byte, output io.Writer, opts *DeltaOptions) (*RsyncPatchWriter, error) {
+	sig_file, err := DeserializeSigFileView(sig)
 	if err != nil {
 		return nil, err
 	}
-	ret.hint = ret.sig.create_sig_hint()
-	ret.buffer = make([]byte, ret.sig.block_size)
+	return newRsyncPatchWriter(sig_file, output, opts)
+}
+
+func newRsyncPatchWriter(sig SigFile, output io.Writer, opts *DeltaOptions) (*RsyncPatchWriter, error) {
+	if opts == nil {
+		opts = &DeltaOptions{}
+	}
+	var ret RsyncPatchWriter
+	total := opts.InputSize
+	if total == 0 {
+		total = -1
+	}
+	ret.progress = newProgressTracker(opts.Progress, opts.ProgressInterval, PhaseDelta, total)
+	ret.max_literal_run = opts.MaxLiteralRun
+	if ret.max_literal_run <= 0 {
+		ret.max_literal_run = DEFAULT_MAX_LITERAL_RUN
+	}
+	ret.sig = sig
+	if ret.sig.block_size == 0 {
+		return nil, errors.New("Signature block size is zero")
+	}
+	if opts.BasisOffset < 0 {
+		return nil, fmt.Errorf("Negative basis offset %d", opts.BasisOffset)
+	}
+	ret.basis_offset = int(opts.BasisOffset)
+	ret.zero_runs = opts.ZeroRuns
+	if ret.sig.chunked() {
+		ret.chunks = ret.sig.new_chunk_index()
+	} else {
+		ret.hint = ret.sig.create_sig_hint()
+		if opts.ZeroRuns {
+			ret.zero_blocks = ret.sig.zero_blocks()
+		}
+		if opts.AppendOnly {
+			ret.append_state = appendScanning
+			if len(ret.sig.signatures) == 0 {
+				ret.append_state = appendTail
+			}
+		}
+		ret.aligned = opts.Aligned
+		ret.roll_after_miss = int64(max(opts.RollAfterMiss, 0))
+	}
+	ret.matcher = newBlockMatcher(&ret.sig, &ret.hint, &ret.stats)
+	ret.tail = make([]byte, 0, 2*ret.sig.block_size)
 	ret.output = output
-	//fmt.Fprintf(os.Stderr, "Ret buffer is %d\n", ret.sig.block_size)
-	_, err = output.Write(DeltaMagic[:])
+	_, err := output.Write(DeltaMagic[:])
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "fail at a a %v\n", err)
 		return nil, err
 	}
 	return &ret, nil
@@ -280,178 +729,327 @@ func select_copy_command(where int, len int) []byte {
 	return output[:1+(1<<logWhereNumBytes)+(1<<logLenNumBytes)]
 }
 
-// this function writes any remaining literals to the output stream to make the way for copies or close
-// it can also write the close command (NUL), if the stream is truly done
-func (self *RsyncPatchWriter) flush_literals(close_stream bool) error {
+// this function writes any remaining literals, followed by extra, to the output stream to make
+// the way for copies or close. It can also write the close command (NUL), if the stream is truly done
+func (self *RsyncPatchWriter) flush_literals(extra []byte, close_stream bool) error {
 	pending := self.pending_literals
 	self.pending_literals = self.pending_literals[:0]
 
-	if len(pending) != 0 {
-		_, err := self.output.Write(select_insert_command(len(pending)))
-		if err != nil {
-			//fmt.Fprintf(os.Stderr, "Failed at X (%d) %v\n", select_insert_command(len(pending)), err)
+	if self.zero_runs && len(pending)+len(extra) != 0 {
+		data := extra
+		if len(pending) != 0 {
+			data = append(pending, extra...)
+		}
+		if err := self.write_literals_and_zeros(data); err != nil {
+			return err
+		}
+		pending, extra = nil, nil
+	}
+	if len(pending)+len(extra) != 0 {
+		if err := self.flush_zeros(); err != nil {
 			return err
 		}
-		_, err = self.output.Write(pending)
+		cmd := select_insert_command(len(pending) + len(extra))
+		self.stats.LiteralCmds += 1
+		self.stats.LiteralBytes += int64(len(pending) + len(extra))
+		self.stats.LiteralCmdBytes += int64(len(cmd))
+		_, err := self.output.Write(cmd)
 		if err != nil {
-			//fmt.Fprintf(os.Stderr, "Failed at Y %d %v\n", len(pending), err)
 			return err
 		}
+		if len(pending) != 0 {
+			_, err = self.output.Write(pending)
+			if err != nil {
+				return err
+			}
+		}
+		if len(extra) != 0 {
+			_, err = self.output.Write(extra)
+			if err != nil {
+				return err
+			}
+		}
 	}
 	if close_stream {
-		_, err := self.output.Write([]byte{RS_OP_END})
-		if err != nil {
-			//fmt.Fprintf(os.Stderr, "Failed at Z 1 %v\n", err)
+		if err := self.flush_zeros(); err != nil {
+			return err
 		}
+		_, err := self.output.Write([]byte{RS_OP_END})
 		return err
 	}
 	return nil
 }
 
 func (self *RsyncPatchWriter) emit_copy(where int, xlen int) error {
-	_, err := self.output.Write(select_copy_command(where, xlen))
-	if err != nil {
-		//fmt.Fprintf(os.Stderr, "Failed at U %d %v\n", len(select_copy_command(where, xlen)), err)
+	block_size := int(self.sig.block_size)
+	if len(self.zero_blocks) != 0 && xlen == block_size && where%block_size == 0 && self.zero_blocks[where/block_size] {
+		self.pending_zeros += xlen
+		return nil
+	}
+	if err := self.flush_zeros(); err != nil {
+		return err
+	}
+	if self.bases != nil {
+		return self.emit_basis_copy(where, xlen)
 	}
+	return self.write_copy(self.basis_offset+where, xlen)
+}
+
+func (self *RsyncPatchWriter) write_copy(where int, xlen int) error {
+	cmd := select_copy_command(where, xlen)
+	self.stats.CopyCmds += 1
+	self.stats.CopyBytes += int64(xlen)
+	self.stats.CopyCmdBytes += int64(len(cmd))
+	_, err := self.output.Write(cmd)
 	return err
 }
-func (self *RsyncPatchWriter) findAndActOnMatch() (bool, error) {
-	if matchLocations, ok := self.hint.crc32_to_sig_index[self.crc32]; ok {
-		if len(matchLocations) != 0 {
-			md4_hasher := md4.New()
-			_, _ = md4_hasher.Write(self.buffer[self.ring_buffer_ptr:])
-			_, _ = md4_hasher.Write(self.buffer[:self.ring_buffer_ptr])
-			hash := md4_hasher.Sum(nil)
-			for _, match := range matchLocations {
-				sigInstance := self.sig.signatures[match]
-				if sigInstance.crc32 != self.crc32 {
-					panic("Corrupt hash index")
-				}
-				if bytes.Equal(hash[:len(sigInstance.crypto_hash)],
-					sigInstance.crypto_hash) {
-						self.flush_literals(false)
-						err := self.emit_copy(match*len(self.buffer), len(self.buffer))
-						self.ring_buffer_ptr = 0
-						self.buffer_fill = 0
-						return true, err
-					}
+
+// consume scans every block sized window of buf that starts before stop,
+// emitting copies for matches and literals for the bytes in between. Unmatched
+// bytes that have not been written yet are left in pending_literals. It returns
+// the position of the first window it did not test, which is at or past stop
+// unless buf ran out of complete windows first.
+func (self *RsyncPatchWriter) consume(buf []byte, stop int) (int, error) {
+	if self.aligned {
+		return self.consume_aligned(buf, stop)
+	}
+	block_size := int(self.sig.block_size)
+	limit := min(stop, len(buf)-block_size+1)
+	pos := 0
+	lit := 0
+	var sum uint32
+	sum_valid := false
+	for pos < limit {
+		if !sum_valid {
+			sum = rollsum.Checksum(buf[pos : pos+block_size])
+		}
+		// never let the literal run grow past max_literal_run
+		scan_limit := min(limit, lit+self.max_literal_run-len(self.pending_literals))
+		match_pos, match, next_sum := self.matcher.scan(buf, pos, scan_limit, sum)
+		if match >= 0 {
+			if err := self.flush_literals(buf[lit:match_pos], false); err != nil {
+				return pos, err
 			}
+			if err := self.emit_copy(match*block_size, block_size); err != nil {
+				return pos, err
+			}
+			pos = match_pos + block_size
+			lit = pos
+			sum_valid = false
+			continue
+		}
+		pos = match_pos
+		sum = next_sum
+		sum_valid = pos+block_size <= len(buf)
+		if len(self.pending_literals)+pos-lit >= self.max_literal_run {
+			if err := self.flush_literals(buf[lit:pos], false); err != nil {
+				return pos, err
+			}
+			lit = pos
 		}
 	}
-	return false, nil
-}
-func (self *RsyncPatchWriter) AssertSameCrc() {
-	sum := uint32(0)
-	sum = crcUpdate(sum, self.buffer[self.ring_buffer_ptr:])
-	sum = crcUpdate(sum, self.buffer[:self.ring_buffer_ptr])
-	if sum != self.crc32 {
-		panic(fmt.Sprintf("%x != %x\n", sum, self.crc32))
-	}
+	self.pending_literals = append(self.pending_literals, buf[lit:pos]...)
+	return pos, nil
 }
-func (self *RsyncPatchWriter) rotate(next byte) (bool, error) {
-	if self.buffer_fill != len(self.buffer) { // the write code didn't get to it
-		panic("buffer fill needs to equal buffer length")
-	}
-	foundMatch, err := self.findAndActOnMatch()
-	if foundMatch {
-		//fmt.Fprintf(os.Stderr, "FoundMatch; resetting buffer_fill at %d\n", self.ring_buffer_ptr)
-		self.buffer_fill = 1
-		self.ring_buffer_ptr = 0
-		self.crc32 = 0
-		self.buffer[0] = next
-		return true, err
-	} else {
-		self.pending_literals = append(self.pending_literals,
-			self.buffer[self.ring_buffer_ptr])
-	}
-	oldCrc := self.crc32
-	self.crc32 = crcRotate(self.crc32, uint32(len(self.buffer)), self.buffer[self.ring_buffer_ptr], next)
-	_ = oldCrc
-	//fmt.Fprintf(os.Stderr, "Rotating %x -> %x results in %x -> %x\n",  self.buffer[self.ring_buffer_ptr], next, oldCrc, self.crc32)
-	self.buffer[self.ring_buffer_ptr] = next
-	self.ring_buffer_ptr += 1
-	if self.ring_buffer_ptr == len(self.buffer) {
-		self.ring_buffer_ptr = 0
+
+// CloseContext is Close unless ctx is already done, in which case the writer
+// fails like WriteContext does and the output is not closed.
+func (self *RsyncPatchWriter) CloseContext(ctx context.Context) error {
+	if self.err != nil {
+		return self.err
 	}
-	return false, err
-}
-func (self *RsyncPatchWriter) compute_full_crc() {
-	if self.ring_buffer_ptr != 0 {
-		panic("full CRC can only be computed from contiguous buffer")
+	if err := ctx.Err(); err != nil {
+		self.err = err
+		return err
 	}
-	self.crc32 = crcUpdate(0, self.buffer[:self.buffer_fill])
+	return self.Close()
 }
+
 func (self *RsyncPatchWriter) Close() error {
-	if self.buffer_fill != len(self.buffer) { // the write code didn't get to it
-		self.compute_full_crc()
+	if self.err != nil {
+		return self.err
 	}
-	for self.buffer_fill != 0 {
-		match, err := self.findAndActOnMatch()
-		if err != nil {
+	if self.append_state == appendScanning {
+		if err := self.close_append(); err != nil {
 			return err
 		}
-		if match {
-			self.pending_literals = append(self.pending_literals,
-				self.buffer[self.ring_buffer_ptr:self.buffer_fill]...)
-
-			self.pending_literals = append(self.pending_literals,
-				self.buffer[:self.ring_buffer_ptr]...)
-			self.ring_buffer_ptr = 0
-			self.buffer_fill = 0 // won't be read, but just for cleanliness
-			break
+	}
+	if self.chunks != nil {
+		if err := self.close_chunks(); err != nil {
+			return err
 		}
-		self.crc32 = crcRollout(self.crc32, uint32(len(self.buffer)), self.buffer[self.ring_buffer_ptr])
-		self.pending_literals = append(self.pending_literals,
-			self.buffer[self.ring_buffer_ptr])
-		self.ring_buffer_ptr += 1
-		if self.ring_buffer_ptr == len(self.buffer) {
-			self.ring_buffer_ptr = 0
+	}
+	// the tail is shorter than a block, so it can only match the final,
+	// possibly short, block of the signature
+	tail := self.tail
+	self.tail = self.tail[:0]
+	var sum rollsum.Rollsum
+	_, _ = sum.Write(tail)
+	for start := 0; start < len(tail); start++ {
+		window := tail[start:]
+		match := self.matcher.lookup(sum.Sum32(), window)
+		// a copy of a few bytes can cost more than sending them
+		if match >= 0 && len(select_copy_command(match*int(self.sig.block_size), len(window))) < len(window) {
+			if err := self.emit_literals(tail[:start]); err != nil {
+				return err
+			}
+			if err := self.flush_literals(nil, false); err != nil {
+				return err
+			}
+			if err := self.emit_copy(match*int(self.sig.block_size), len(window)); err != nil {
+				return err
+			}
+			tail = tail[:0]
+			break
 		}
-		self.buffer_fill -= 1
+		sum.Rollout(window[0])
 	}
-	err := self.flush_literals(true)
-	if err != nil {
+	// pending literals and the unmatched tail can together pass max_literal_run
+	if err := self.emit_literals(tail); err != nil {
+		return err
+	}
+	if err := self.flush_literals(nil, true); err != nil {
 		return err
 	}
+	self.progress.finish()
 	if closer, ok := self.output.(io.WriteCloser); ok {
-		xerr := closer.Close()
-		fmt.Fprintf(os.Stderr, "X_X %v\n", xerr)
-		return xerr
+		return closer.Close()
 	}
 	return nil
 }
 
-func (self *RsyncPatchWriter) Write(data []byte) (int, error) {
-	//fmt.Fprintf(os.Stderr, "Patch Writer writing %d bytes\n", len(data))
+// Stats reports what the delta has been made of so far; it is complete once
+// Close has returned.
+func (self *RsyncPatchWriter) Stats() DeltaStats {
+	stats := self.stats
+	stats.SigBlocks = len(self.sig.signatures)
+	stats.BlockSize = self.sig.block_size
+	return stats
+}
+
+// WriteContext is Write checking ctx once per signature block of input. When
+// ctx is done it returns ctx.Err() and the writer fails every later call with
+// the same error. The output then holds whole commands but no end command, so
+// ApplyPatch rejects it rather than producing a truncated file.
+func (self *RsyncPatchWriter) WriteContext(ctx context.Context, data []byte) (int, error) {
 	var data_written = 0
 	for {
-		if len(data) != 0 && self.buffer_fill < len(self.buffer) {
-			to_copy := min(self.buffer_fill+len(data), len(self.buffer)) - self.buffer_fill
-			copy(self.buffer[self.buffer_fill:self.buffer_fill+to_copy], data[:to_copy])
-			self.buffer_fill += to_copy
-			data_written += to_copy
-			data = data[to_copy:]
-			if self.buffer_fill == len(self.buffer) {
-				self.compute_full_crc()
-			}
+		if self.err != nil {
+			return data_written, self.err
+		}
+		if err := ctx.Err(); err != nil {
+			self.err = err
+			return data_written, err
 		}
-		if len(data) == 0 || self.buffer_fill < len(self.buffer) {
+		if len(data) == 0 {
 			return data_written, nil
 		}
-		// buffer is full
-		lastProcessedIndex := 0
-		for index, cur := range data {
-			lastProcessedIndex = index
-			emittedMatch, err := self.rotate(cur)
-			data_written += 1
-			if err != nil {
-				return data_written, err
-			}
-			if emittedMatch {
-				//fmt.Fprintf(os.Stderr, "EmittedMatch at %d\n", data_written)
-				break
+		chunk := data[:min(len(data), int(self.sig.block_size))]
+		n, err := self.Write(chunk)
+		data_written += n
+		if err != nil {
+			return data_written, err
+		}
+		data = data[len(chunk):]
+	}
+}
+
+// readFromBufferSize is the size of the buffer ReadFrom fills from its source;
+// large reads keep the windows that straddle two reads rare
+const readFromBufferSize = 256 * 1024
+
+// ReadFrom feeds everything input produces to Write, so io.Copy into a
+// RsyncPatchWriter uses one large internal buffer. It does not call Close.
+// With ZeroRuns, holes are skipped when input is an *os.File; io.Copy hides
+// the file behind a wrapper, so call ReadFrom directly for that.
+func (self *RsyncPatchWriter) ReadFrom(input io.Reader) (int64, error) {
+	buffer := make([]byte, max(readFromBufferSize, 4*int(self.sig.block_size)))
+	if file, ok := input.(*os.File); ok && self.zero_runs {
+		return self.readFromSparse(file, buffer)
+	}
+	return self.readAll(input, buffer)
+}
+
+func (self *RsyncPatchWriter) readAll(input io.Reader, buffer []byte) (int64, error) {
+	var read int64
+	for {
+		n, err := input.Read(buffer)
+		if n > 0 {
+			read += int64(n)
+			if _, werr := self.Write(buffer[:n]); werr != nil {
+				return read, werr
 			}
 		}
-		data = data[lastProcessedIndex+1:]
+		if err == io.EOF {
+			return read, nil
+		}
+		if err != nil {
+			return read, err
+		}
+	}
+}
+
+func (self *RsyncPatchWriter) Write(data []byte) (int, error) {
+	if self.err != nil {
+		return 0, self.err
+	}
+	if self.progress.fn == nil {
+		return self.write(data)
+	}
+	var data_written = 0
+	for len(data) != 0 {
+		chunk := data[:min(len(data), int(self.progress.interval))]
+		n, err := self.write(chunk)
+		data_written += n
+		self.progress.add(int64(n))
+		if err != nil {
+			return data_written, err
+		}
+		data = data[len(chunk):]
+	}
+	return data_written, nil
+}
+
+// write rolls the checksum directly over data. Only the windows that straddle
+// the previous call's data and this one are assembled in the tail buffer, and
+// the last partial window is copied there for the next call or Close.
+func (self *RsyncPatchWriter) write(data []byte) (int, error) {
+	if self.chunks != nil {
+		return self.write_chunks(data)
+	}
+	switch self.append_state {
+	case appendScanning:
+		return self.write_append(data)
+	case appendTail:
+		self.stats.InBytes += int64(len(data))
+		return len(data), self.emit_literals(data)
+	}
+	offset := self.stats.InBytes
+	self.stats.InBytes += int64(len(data))
+	data_written := len(data)
+	block_size := int(self.sig.block_size)
+	if len(self.tail) != 0 {
+		tail_len := len(self.tail)
+		joined := append(self.tail, data[:min(len(data), block_size)]...)
+		self.buf_offset = offset - int64(tail_len)
+		pos, err := self.consume(joined, tail_len)
+		if err != nil {
+			return 0, err
+		}
+		if pos < tail_len {
+			// data was too short to finish a window, so all of it is in joined
+			self.tail = joined[:copy(joined, joined[pos:])]
+			return len(data), nil
+		}
+		self.tail = self.tail[:0]
+		data = data[pos-tail_len:]
+		offset += int64(pos - tail_len)
+	}
+	self.buf_offset = offset
+	pos, err := self.consume(data, len(data))
+	if err != nil {
+		return 0, err
 	}
+	self.tail = append(self.tail, data[pos:]...)
+	return data_written, nil
 }
@@ -24,8 +24,20 @@ package rsync
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
+	"time"
+
+	"github.com/danielrh/go-rsync/cdc"
+	"golang.org/x/crypto/md4"
 )
 
 var baseFile = []byte(`Mary had a little lamb
@@ -130,3 +142,1726 @@ func TestSigDeltaPatch(t *testing.T) {
 		panic(finalOutputHex + "\nmust ==\n" + fixedHex)
 	}
 }
+
+func TestApplyPatchLimits(t *testing.T) {
+	sig := NewSigFile(11, baseFile, 8)
+	var sigDisk bytes.Buffer
+	err := sig.Serialize(&sigDisk)
+	if err != nil {
+		panic(err)
+	}
+	var patchOut bytes.Buffer
+	patchWriter, perr := NewRsyncPatchWriter(sigDisk.Bytes(), &patchOut)
+	if perr != nil {
+		panic(perr)
+	}
+	_, err = patchWriter.Write(changedFile)
+	if err != nil {
+		panic(err)
+	}
+	err = patchWriter.Close()
+	if err != nil {
+		panic(err)
+	}
+	var finalOutput bytes.Buffer
+	err = ApplyPatchWithOptions(baseFile, patchOut.Bytes(), &finalOutput, &PatchOptions{
+		MaxOutputBytes: int64(len(changedFile)),
+	})
+	if err != nil {
+		panic(err)
+	}
+	for _, opts := range []PatchOptions{
+		{MaxOutputBytes: int64(len(changedFile)) - 1},
+		{MaxCommands: 3},
+		{MaxCommandLength: 10},
+	} {
+		finalOutput.Reset()
+		err = ApplyPatchWithOptions(baseFile, patchOut.Bytes(), &finalOutput, &opts)
+		limitErr, ok := err.(*PatchLimitError)
+		if !ok {
+			panic(fmt.Sprintf("expected limit error for %+v, got %v", opts, err))
+		}
+		if limitErr.Value <= limitErr.Max {
+			panic(limitErr.Error())
+		}
+		if opts.MaxOutputBytes != 0 && int64(finalOutput.Len()) > opts.MaxOutputBytes {
+			panic("output written past the limit")
+		}
+	}
+	// a tiny delta declaring an enormous literal must be refused up front
+	huge := append(append([]byte{}, DeltaMagic...), RS_OP_LITERAL_N8, 0, 0, 1, 0, 0, 0, 0, 0)
+	err = ApplyPatchWithOptions(nil, huge, &finalOutput, &PatchOptions{MaxOutputBytes: 1 << 30})
+	if limitErr, ok := err.(*PatchLimitError); !ok || limitErr.Limit != LimitOutputBytes {
+		panic(fmt.Sprintf("expected output limit error, got %v", err))
+	}
+	// copies outside the basis are an error rather than a panic
+	outside := append(append([]byte{}, DeltaMagic...), RS_OP_COPY_N1_N1, 200, 10, RS_OP_END)
+	if ApplyPatch(baseFile[:100], outside, &finalOutput) == nil {
+		panic("copy outside basis accepted")
+	}
+}
+
+func TestRecommendedSigArgs(t *testing.T) {
+	block_size, sum_size, err := RecommendedSigArgs(-1, 0, 0)
+	if err != nil || block_size != DEFAULT_BLOCK_SIZE || sum_size != MD4_SUM_SIZE {
+		panic(fmt.Sprintf("%d %d %v", block_size, sum_size, err))
+	}
+	block_size, sum_size, err = RecommendedSigArgs(1000*1000*1000, 0, -1)
+	if err != nil || block_size != 31616 || sum_size != 8 {
+		panic(fmt.Sprintf("%d %d %v", block_size, sum_size, err))
+	}
+	_, _, err = RecommendedSigArgs(1000, 2048, MD4_SUM_SIZE+1)
+	if err == nil {
+		panic("oversized strong sum accepted")
+	}
+}
+
+func TestStrongHashes(t *testing.T) {
+	for _, strong := range []StrongHash{MD4, BLAKE2, SHA256} {
+		sig, err := NewSigFileContext(context.Background(), 11, baseFile, uint32(strong.Size()),
+			&SigOptions{Hash: strong})
+		if err != nil {
+			panic(err)
+		}
+		var sigDisk bytes.Buffer
+		if err = sig.Serialize(&sigDisk); err != nil {
+			panic(err)
+		}
+		magic := strong.Magic()
+		if !bytes.Equal(sigDisk.Bytes()[:4], magic[:]) {
+			panic(strong.Name() + " signature has the wrong magic")
+		}
+		sig2, err := DeserializeSigFileView(sigDisk.Bytes())
+		if err != nil {
+			panic(err)
+		}
+		if sig2.Hash() != strong {
+			panic(strong.Name() + " read back as " + sig2.Hash().Name())
+		}
+		var patchOut bytes.Buffer
+		patchWriter, err := NewRsyncPatchWriter(sigDisk.Bytes(), &patchOut)
+		if err != nil {
+			panic(err)
+		}
+		if _, err = patchWriter.Write(changedFile); err != nil {
+			panic(err)
+		}
+		if err = patchWriter.Close(); err != nil {
+			panic(err)
+		}
+		if patchWriter.Stats().CopyCmds == 0 {
+			panic(strong.Name() + " delta found no matching blocks")
+		}
+		var finalOutput bytes.Buffer
+		if err = ApplyPatch(baseFile, patchOut.Bytes(), &finalOutput); err != nil {
+			panic(err)
+		}
+		if !bytes.Equal(finalOutput.Bytes(), changedFile) {
+			panic(strong.Name() + " round trip mismatch")
+		}
+	}
+	_, err := NewSigFileContext(context.Background(), 11, baseFile, MD4_SUM_SIZE+1, nil)
+	if err == nil {
+		panic("oversized strong sum accepted")
+	}
+	_, sum_size, err := RecommendedSigArgsForHash(-1, 0, 0, SHA256)
+	if err != nil || sum_size != SHA256_SUM_SIZE {
+		panic(fmt.Sprintf("%d %v", sum_size, err))
+	}
+
+	custom := NewStrongHash("test-sha256", [4]byte{0x72, 0x73, 0xff, 0x01}, SHA256_SUM_SIZE, SHA256.New)
+	if err = RegisterStrongHash(custom); err != nil {
+		panic(err)
+	}
+	if found, ok := LookupStrongHash("test-sha256"); !ok || found != custom {
+		panic("registered hash not found")
+	}
+	if RegisterStrongHash(custom) == nil {
+		panic("duplicate name accepted")
+	}
+	if RegisterStrongHash(NewStrongHash("other", MD4_MAGIC, MD4_SUM_SIZE, MD4.New)) == nil {
+		panic("duplicate magic accepted")
+	}
+	sig := NewSigFileWithOptions(11, baseFile, 8, &SigOptions{Hash: custom})
+	var sigDisk bytes.Buffer
+	if err = sig.Serialize(&sigDisk); err != nil {
+		panic(err)
+	}
+	if sig2, err := DeserializeSigFileView(sigDisk.Bytes()); err != nil || sig2.Hash() != custom {
+		panic(fmt.Sprintf("custom signature read back as %v, %v", sig2.Hash(), err))
+	}
+}
+
+func deltaStats(sigDisk []byte, input []byte) DeltaStats {
+	var patchOut bytes.Buffer
+	patchWriter, err := NewRsyncPatchWriter(sigDisk, &patchOut)
+	if err != nil {
+		panic(err)
+	}
+	if _, err = patchWriter.Write(input); err != nil {
+		panic(err)
+	}
+	if err = patchWriter.Close(); err != nil {
+		panic(err)
+	}
+	var finalOutput bytes.Buffer
+	if err = ApplyPatch(baseFile, patchOut.Bytes(), &finalOutput); err != nil {
+		panic(err)
+	}
+	if !bytes.Equal(finalOutput.Bytes(), input) {
+		panic("round trip mismatch")
+	}
+	return patchWriter.Stats()
+}
+
+func TestSeededSignature(t *testing.T) {
+	seed, err := NewSeed()
+	if err != nil {
+		panic(err)
+	}
+	plain := NewSigFileWithOptions(11, baseFile, 8, &SigOptions{Hash: BLAKE2})
+	sig := NewSigFileWithOptions(11, baseFile, 8, &SigOptions{Hash: BLAKE2, Seed: seed})
+	if bytes.Equal(plain.signatures[0].crypto_hash, sig.signatures[0].crypto_hash) {
+		panic("seed did not change the strong sums")
+	}
+	var sigDisk bytes.Buffer
+	if err = sig.Serialize(&sigDisk); err != nil {
+		panic(err)
+	}
+	if !bytes.Equal(sigDisk.Bytes()[:4], EXTENDED_SIG_MAGIC[:]) {
+		panic("seeded signature written with a classic header")
+	}
+	sig2, err := DeserializeSigFileView(sigDisk.Bytes())
+	if err != nil {
+		panic(err)
+	}
+	if sig2.Hash() != BLAKE2 || !bytes.Equal(sig2.Seed(), seed) || len(sig2.signatures) != len(sig.signatures) {
+		panic(fmt.Sprintf("read back %s seed %x with %d blocks", sig2.Hash().Name(), sig2.Seed(), len(sig2.signatures)))
+	}
+	var sigDisk2 bytes.Buffer
+	if err = sig2.Serialize(&sigDisk2); err != nil {
+		panic(err)
+	}
+	if !bytes.Equal(sigDisk.Bytes(), sigDisk2.Bytes()) {
+		panic("seeded signature did not round trip")
+	}
+	if deltaStats(sigDisk.Bytes(), changedFile).CopyCmds == 0 {
+		panic("seeded delta found no matching blocks")
+	}
+	// the delta side has to use the same seed for any block to match
+	wrongSeed := append([]byte{}, sigDisk.Bytes()...)
+	wrongSeed[bytes.Index(wrongSeed, seed)] ^= 1
+	if stats := deltaStats(wrongSeed, changedFile); stats.CopyCmds != 0 {
+		panic(fmt.Sprintf("%d copies matched with the wrong seed", stats.CopyCmds))
+	}
+	for _, size := range []int{EXTENDED_HEADER_SIZE - 1, EXTENDED_HEADER_SIZE + 3, EXTENDED_HEADER_SIZE + 10} {
+		if _, err = DeserializeSigFileView(sigDisk.Bytes()[:size]); err == nil {
+			panic(fmt.Sprintf("truncated %d byte header accepted", size))
+		}
+	}
+}
+
+func TestVerifyAgainstSignature(t *testing.T) {
+	seed, err := NewSeed()
+	if err != nil {
+		panic(err)
+	}
+	for _, opts := range []*SigOptions{nil, {Hash: SHA256, Seed: seed}} {
+		sig := NewSigFileWithOptions(11, baseFile, 8, opts)
+		var sigDisk bytes.Buffer
+		if err = sig.Serialize(&sigDisk); err != nil {
+			panic(err)
+		}
+		report, err := VerifyAgainstSignature(bytes.NewReader(sigDisk.Bytes()), bytes.NewReader(baseFile))
+		if err != nil || !report.OK() || report.FileLength != int64(len(baseFile)) {
+			panic(fmt.Sprintf("%+v %v", report, err))
+		}
+		corrupt := append([]byte{}, baseFile...)
+		corrupt[30] ^= 0x40
+		corrupt[len(corrupt)-1] ^= 0x01
+		report, err = VerifyAgainstSignature(bytes.NewReader(sigDisk.Bytes()), bytes.NewReader(corrupt))
+		if err != nil || report.LengthChanged || len(report.Mismatches) != 2 {
+			panic(fmt.Sprintf("%+v %v", report, err))
+		}
+		last := len(sig.signatures) - 1
+		if report.Mismatches[0] != (BlockMismatch{Index: 2, Offset: 22, Weak: true, Strong: true}) ||
+			report.Mismatches[1].Index != last || !report.Mismatches[1].Strong {
+			panic(fmt.Sprintf("%+v", report.Mismatches))
+		}
+		report, err = VerifyAgainstSignature(bytes.NewReader(sigDisk.Bytes()), bytes.NewReader(baseFile[:50]))
+		if err != nil || !report.LengthChanged || report.FileBlocks != 5 || len(report.Mismatches) != 1 {
+			panic(fmt.Sprintf("%+v %v", report, err))
+		}
+	}
+}
+
+func TestCompareSignatures(t *testing.T) {
+	var newFile []byte
+	newFile = append(newFile, baseFile[22:44]...)
+	newFile = append(newFile, baseFile[:22]...)
+	newFile = append(newFile, bytes.Repeat([]byte{'X'}, 11)...)
+	newFile = append(newFile, baseFile[55:]...)
+	old_sig := NewSigFile(11, baseFile, 8)
+	new_sig := NewSigFile(11, newFile, 8)
+	cmp, err := CompareSignatures(&old_sig, &new_sig)
+	if err != nil {
+		panic(err)
+	}
+	blocks := len(new_sig.signatures)
+	expected := []BlockRange{
+		{Kind: BlockMoved, Start: 0, Count: 2, OldStart: 2},
+		{Kind: BlockMoved, Start: 2, Count: 2, OldStart: 0},
+		{Kind: BlockChanged, Start: 4, Count: 1, OldStart: -1},
+		{Kind: BlockUnchanged, Start: 5, Count: blocks - 5, OldStart: 5},
+	}
+	if fmt.Sprint(cmp.Ranges) != fmt.Sprint(expected) {
+		panic(fmt.Sprintf("%v\nmust ==\n%v", cmp.Ranges, expected))
+	}
+	if cmp.UnchangedCount != blocks-5 || cmp.MovedCount != 4 || cmp.ChangedCount != 1 ||
+		cmp.Estimate.CopyCmds != int64(blocks-1) || cmp.Estimate.LiteralBytes != 11 {
+		panic(fmt.Sprintf("%+v", cmp))
+	}
+	if cmp.EstimatedDeltaSize() >= int64(len(newFile)) {
+		panic(fmt.Sprintf("estimated %d bytes for a %d byte file", cmp.EstimatedDeltaSize(), len(newFile)))
+	}
+	other := NewSigFile(12, newFile, 8)
+	if _, err = CompareSignatures(&old_sig, &other); err == nil {
+		panic("signatures with different block sizes compared")
+	}
+
+	// the estimate is close to the delta RsyncPatchWriter really writes
+	base := make([]byte, 1<<20)
+	rand.New(rand.NewSource(3)).Read(base)
+	edited := append([]byte{}, base...)
+	copy(edited[300000:], "an edit in the middle")
+	old_sig = NewSigFile(1024, base, 8)
+	new_sig = NewSigFile(1024, edited, 8)
+	if cmp, err = CompareSignatures(&old_sig, &new_sig); err != nil {
+		panic(err)
+	}
+	var sigDisk bytes.Buffer
+	if err = old_sig.Serialize(&sigDisk); err != nil {
+		panic(err)
+	}
+	delta, _ := roundTripDelta(sigDisk.Bytes(), base, nil, edited, len(edited))
+	if estimate := cmp.EstimatedDeltaSize(); estimate < int64(len(delta)) || estimate > int64(len(delta))*11/10 {
+		panic(fmt.Sprintf("estimated %d bytes for a %d byte delta", estimate, len(delta)))
+	}
+}
+
+func TestExtendedSigHeader(t *testing.T) {
+	created := time.Unix(1500000000, 123)
+	sig := NewSigFileWithOptions(11, baseFile, 8, &SigOptions{
+		Extended: true,
+		Created:  created,
+		Metadata: map[string]string{"path": "mary.txt", "owner": ""},
+	})
+	var sigDisk bytes.Buffer
+	if err := sig.Serialize(&sigDisk); err != nil {
+		panic(err)
+	}
+	if !bytes.Equal(sigDisk.Bytes()[:4], EXTENDED_SIG_MAGIC[:]) {
+		panic("extended signature written with a classic header")
+	}
+	// readers skip fields they don't know
+	data := sigDisk.Bytes()
+	fields_size := be_to_u32(data[16:EXTENDED_HEADER_SIZE])
+	unknown := appendSigField(nil, 0xffff, []byte("future"))
+	var patched []byte
+	patched = append(patched, data[:16]...)
+	patched = appendU32(patched, fields_size+uint32(len(unknown)))
+	patched = append(patched, unknown...)
+	patched = append(patched, data[EXTENDED_HEADER_SIZE:]...)
+	sig2, err := DeserializeSigFileView(patched)
+	if err != nil {
+		panic(err)
+	}
+	header, ok := sig2.Header()
+	fileHash := md4.New()
+	fileHash.Write(baseFile)
+	if !ok || header.BasisLength != int64(len(baseFile)) || header.FileHashAlgo != MD4 ||
+		!bytes.Equal(header.FileHash, fileHash.Sum(nil)) || !header.Created.Equal(created) ||
+		len(header.Metadata) != 2 || header.Metadata["path"] != "mary.txt" {
+		panic(fmt.Sprintf("%+v", header))
+	}
+	if len(sig2.signatures) != len(sig.signatures) || sig2.Hash() != MD4 || sig2.Seed() != nil {
+		panic("extended signature records did not round trip")
+	}
+	var sigDisk2 bytes.Buffer
+	if err = sig2.Serialize(&sigDisk2); err != nil {
+		panic(err)
+	}
+	if !bytes.Equal(sigDisk2.Bytes(), data) {
+		panic("extended signature did not round trip")
+	}
+	// the recorded length catches a final block that only got shorter
+	report, err := sig2.Verify(bytes.NewReader(baseFile[:len(baseFile)-1]))
+	if err != nil || !report.LengthChanged {
+		panic(fmt.Sprintf("%+v %v", report, err))
+	}
+	classic := NewSigFile(11, baseFile, 8)
+	if _, ok = classic.Header(); ok {
+		panic("classic signature has an extended header")
+	}
+}
+
+func TestMapFile(t *testing.T) {
+	dir := t.TempDir()
+	sig := NewSigFile(11, baseFile, 8)
+	var sigDisk bytes.Buffer
+	if err := sig.Serialize(&sigDisk); err != nil {
+		panic(err)
+	}
+	files := map[string][]byte{"sig": sigDisk.Bytes(), "basis": baseFile, "empty": nil}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0666); err != nil {
+			panic(err)
+		}
+	}
+	mappedSig, err := MapFile(filepath.Join(dir, "sig"))
+	if err != nil {
+		panic(err)
+	}
+	defer mappedSig.Close()
+	mappedBasis, err := MapFile(filepath.Join(dir, "basis"))
+	if err != nil {
+		panic(err)
+	}
+	defer mappedBasis.Close()
+	if runtime.GOOS == "linux" && !mappedBasis.Mapped() {
+		panic("basis was read rather than mapped")
+	}
+	if !bytes.Equal(mappedBasis.Bytes(), baseFile) || !bytes.Equal(mappedSig.Bytes(), sigDisk.Bytes()) {
+		panic("mapped contents differ from the files")
+	}
+	var patchOut bytes.Buffer
+	patchWriter, err := NewRsyncPatchWriter(mappedSig.Bytes(), &patchOut)
+	if err != nil {
+		panic(err)
+	}
+	if _, err = patchWriter.Write(changedFile); err != nil {
+		panic(err)
+	}
+	if err = patchWriter.Close(); err != nil {
+		panic(err)
+	}
+	var finalOutput bytes.Buffer
+	if err = ApplyPatch(mappedBasis.Bytes(), patchOut.Bytes(), &finalOutput); err != nil {
+		panic(err)
+	}
+	if !bytes.Equal(finalOutput.Bytes(), changedFile) {
+		panic("patch against mapped basis mismatch")
+	}
+	empty, err := MapFile(filepath.Join(dir, "empty"))
+	if err != nil || len(empty.Bytes()) != 0 || empty.Close() != nil {
+		panic(fmt.Sprintf("empty file: %v", err))
+	}
+	if _, err = MapFile(filepath.Join(dir, "missing")); err == nil {
+		panic("missing file mapped")
+	}
+}
+
+func TestApplyPatchFile(t *testing.T) {
+	dir := t.TempDir()
+	sig := NewSigFile(11, baseFile, 8)
+	var sigDisk bytes.Buffer
+	if err := sig.Serialize(&sigDisk); err != nil {
+		panic(err)
+	}
+	var patchOut bytes.Buffer
+	patchWriter, err := NewRsyncPatchWriter(sigDisk.Bytes(), &patchOut)
+	if err != nil {
+		panic(err)
+	}
+	if _, err = patchWriter.Write(changedFile); err != nil {
+		panic(err)
+	}
+	if err = patchWriter.Close(); err != nil {
+		panic(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "basis"), baseFile, 0666); err != nil {
+		panic(err)
+	}
+	base, err := os.Open(filepath.Join(dir, "basis"))
+	if err != nil {
+		panic(err)
+	}
+	defer base.Close()
+	// O_APPEND output makes copy_file_range fail, exercising the fallback
+	for _, flags := range []int{0, os.O_APPEND} {
+		output, err := os.OpenFile(filepath.Join(dir, "output"), os.O_RDWR|os.O_CREATE|os.O_TRUNC|flags, 0666)
+		if err != nil {
+			panic(err)
+		}
+		if _, err = output.Write([]byte("prefix")); err != nil {
+			panic(err)
+		}
+		if err = ApplyPatchFile(base, patchOut.Bytes(), output, nil); err != nil {
+			panic(err)
+		}
+		output.Close()
+		result, err := os.ReadFile(filepath.Join(dir, "output"))
+		if err != nil {
+			panic(err)
+		}
+		if !bytes.Equal(result, append([]byte("prefix"), changedFile...)) {
+			panic(fmt.Sprintf("flags %x: patched file mismatch", flags))
+		}
+	}
+	output, err := os.Create(filepath.Join(dir, "short"))
+	if err != nil {
+		panic(err)
+	}
+	defer output.Close()
+	short, err := os.Open(filepath.Join(dir, "output"))
+	if err != nil {
+		panic(err)
+	}
+	defer short.Close()
+	outside := append(append([]byte{}, DeltaMagic...), RS_OP_COPY_N1_N1+4, 0x10, 0, 10, RS_OP_END)
+	if ApplyPatchFile(short, outside, output, nil) == nil {
+		panic("copy outside basis accepted")
+	}
+}
+
+func TestZeroRuns(t *testing.T) {
+	zeros := func(n int) []byte { return make([]byte, n) }
+	var base, newFile []byte
+	base = append(append(append(base, baseFile...), zeros(4096)...), baseFile...)
+	newFile = append(append(newFile, changedFile...), zeros(200000)...)
+	newFile = append(append(newFile, baseFile...), zeros(300)...)
+	sig := NewSigFile(64, base, 8)
+	zero := sig.zeroBlockSig()
+	hasher := md4.New()
+	hasher.Write(zeros(64))
+	if !bytes.Equal(zero.crypto_hash, hasher.Sum(nil)[:8]) {
+		panic("zero block signature is wrong")
+	}
+	zero_count := 0
+	for index, item := range sig.zero_blocks() {
+		if item {
+			zero_count += 1
+			if !bytes.Equal(sig.signatures[index].crypto_hash, zero.crypto_hash) {
+				panic("zero block has the wrong strong sum")
+			}
+		}
+	}
+	if zero_count < 4096/64-1 {
+		panic(fmt.Sprintf("only %d zero blocks", zero_count))
+	}
+	var sigDisk bytes.Buffer
+	if err := sig.Serialize(&sigDisk); err != nil {
+		panic(err)
+	}
+	delta := func(opts *DeltaOptions, input io.Reader) ([]byte, DeltaStats) {
+		var patchOut bytes.Buffer
+		patchWriter, err := NewRsyncPatchWriterWithOptions(sigDisk.Bytes(), &patchOut, opts)
+		if err != nil {
+			panic(err)
+		}
+		if _, err = patchWriter.ReadFrom(input); err != nil {
+			panic(err)
+		}
+		if err = patchWriter.Close(); err != nil {
+			panic(err)
+		}
+		return patchOut.Bytes(), patchWriter.Stats()
+	}
+	plain, _ := delta(nil, bytes.NewReader(newFile))
+	sparse, stats := delta(&DeltaOptions{ZeroRuns: true}, bytes.NewReader(newFile))
+	if stats.ZeroCmds == 0 || stats.ZeroBytes < 200000 || len(sparse) >= len(plain) {
+		panic(fmt.Sprintf("%v: %d byte delta against %d", stats, len(sparse), len(plain)))
+	}
+	var finalOutput bytes.Buffer
+	if _, err := io.Copy(&finalOutput, mustPatch(base, sparse)); err != nil {
+		panic(err)
+	}
+	if !bytes.Equal(finalOutput.Bytes(), newFile) {
+		panic("zero run delta mismatch")
+	}
+	info, err := InspectDelta(sparse)
+	if err != nil || info.ZeroBytes != stats.ZeroBytes {
+		panic(fmt.Sprintf("inspect found %d zero bytes: %v", info.ZeroBytes, err))
+	}
+
+	// a sparse input file is read around its holes, and patching to a file
+	// leaves holes where the zero runs are
+	dir := t.TempDir()
+	input, err := os.Create(filepath.Join(dir, "input"))
+	if err != nil {
+		panic(err)
+	}
+	defer input.Close()
+	if _, err = input.Write(newFile[:len(changedFile)]); err != nil {
+		panic(err)
+	}
+	if _, err = input.WriteAt(newFile[len(changedFile)+200000:], int64(len(changedFile)+200000)); err != nil {
+		panic(err)
+	}
+	if _, err = input.Seek(0, io.SeekStart); err != nil {
+		panic(err)
+	}
+	fromFile, fileStats := delta(&DeltaOptions{ZeroRuns: true}, input)
+	if fileStats.InBytes != int64(len(newFile)) || fileStats.ZeroBytes < 200000 {
+		panic(fmt.Sprintf("%v", fileStats))
+	}
+	if err = os.WriteFile(filepath.Join(dir, "basis"), base, 0666); err != nil {
+		panic(err)
+	}
+	basis, err := os.Open(filepath.Join(dir, "basis"))
+	if err != nil {
+		panic(err)
+	}
+	defer basis.Close()
+	output, err := os.Create(filepath.Join(dir, "output"))
+	if err != nil {
+		panic(err)
+	}
+	if err = ApplyPatchFile(basis, fromFile, output, nil); err != nil {
+		panic(err)
+	}
+	output.Close()
+	result, err := os.ReadFile(filepath.Join(dir, "output"))
+	if err != nil {
+		panic(err)
+	}
+	if !bytes.Equal(result, newFile) {
+		panic("sparse file patch mismatch")
+	}
+}
+
+func mustPatch(base []byte, delta []byte) *Patch {
+	patch, err := NewPatch(base, delta, nil)
+	if err != nil {
+		panic(err)
+	}
+	return patch
+}
+
+// inPlaceFiles returns a random basis and a copy of it with a few runs
+// overwritten at arbitrary offsets, and a copy with a few bytes inserted
+func inPlaceFiles(size int) ([]byte, []byte, []byte) {
+	rng := rand.New(rand.NewSource(int64(size)))
+	base := make([]byte, size)
+	rng.Read(base)
+	changed := append([]byte{}, base...)
+	for i := 0; i < size/(64*1024); i++ {
+		start := rng.Intn(size - 100)
+		rng.Read(changed[start : start+rng.Intn(100)+1])
+	}
+	inserted := append(append(append([]byte{}, base[:size/3]...), "inserted"...), base[size/3:]...)
+	return base, changed, inserted
+}
+
+// roundTripDelta writes input to a delta writer in writeSize chunks and checks
+// that the delta patches base back into input
+func roundTripDelta(sigDisk []byte, base []byte, opts *DeltaOptions, input []byte, writeSize int) ([]byte, DeltaStats) {
+	var patchOut bytes.Buffer
+	patchWriter, err := NewRsyncPatchWriterWithOptions(sigDisk, &patchOut, opts)
+	if err != nil {
+		panic(err)
+	}
+	for data := input; len(data) != 0; {
+		chunk := data[:min(len(data), writeSize)]
+		if _, err = patchWriter.Write(chunk); err != nil {
+			panic(err)
+		}
+		data = data[len(chunk):]
+	}
+	if err = patchWriter.Close(); err != nil {
+		panic(err)
+	}
+	var finalOutput bytes.Buffer
+	if err = ApplyPatch(base, patchOut.Bytes(), &finalOutput); err != nil {
+		panic(err)
+	}
+	if !bytes.Equal(finalOutput.Bytes(), input) {
+		panic(fmt.Sprintf("%+v: round trip mismatch", opts))
+	}
+	return patchOut.Bytes(), patchWriter.Stats()
+}
+
+func TestAppendOnlyDelta(t *testing.T) {
+	log, _ := benchmarkFiles(100000)
+	appended := []byte("2026-10-18 12:00:00 rotated\n")
+	for _, baseLength := range []int{0, 10, 1024, 50000, 50001} {
+		base := log[:baseLength]
+		grown := append(append([]byte(nil), base...), appended...)
+		sig := NewSigFile(1024, base, 8)
+		var sigDisk bytes.Buffer
+		if err := sig.Serialize(&sigDisk); err != nil {
+			panic(err)
+		}
+		for _, writeSize := range []int{1, 7, 1000, len(grown)} {
+			_, stats := roundTripDelta(sigDisk.Bytes(), base, &DeltaOptions{AppendOnly: true}, grown, writeSize)
+			copies := int64(1)
+			if baseLength == 0 {
+				copies = 0
+			}
+			if stats.CopyCmds != copies || stats.LiteralBytes != int64(len(appended)) || stats.WeakHits != int64(len(sig.signatures)) {
+				panic(fmt.Sprintf("%d byte base, %d byte writes: %v", baseLength, writeSize, stats))
+			}
+		}
+	}
+	// a rewritten record falls back to the rolling search after it
+	base := log[:50000]
+	changed := append(append([]byte(nil), base...), appended...)
+	copy(changed[30000:], "rewritten")
+	sig := NewSigFile(1024, base, 8)
+	var sigDisk bytes.Buffer
+	if err := sig.Serialize(&sigDisk); err != nil {
+		panic(err)
+	}
+	_, rolling := roundTripDelta(sigDisk.Bytes(), base, nil, changed, len(changed))
+	for _, writeSize := range []int{7, 1000, len(changed)} {
+		_, stats := roundTripDelta(sigDisk.Bytes(), base, &DeltaOptions{AppendOnly: true}, changed, writeSize)
+		if stats.LiteralBytes != rolling.LiteralBytes {
+			panic(fmt.Sprintf("append only %v\nrolling %v", stats, rolling))
+		}
+	}
+}
+
+func TestChunkedSignature(t *testing.T) {
+	base, changed := benchmarkFiles(1 << 20)
+	opts := SigOptions{Chunking: cdc.NewParams(4096)}
+	sig, err := NewSigFileContext(context.Background(), 0, base, 8, &opts)
+	if err != nil {
+		panic(err)
+	}
+	var sigDisk bytes.Buffer
+	if err = sig.Serialize(&sigDisk); err != nil {
+		panic(err)
+	}
+	read, err := DeserializeSigFileView(sigDisk.Bytes())
+	if err != nil {
+		panic(err)
+	}
+	var again bytes.Buffer
+	if _, err = read.WriteTo(&again); err != nil {
+		panic(err)
+	}
+	if read.Chunking() != opts.Chunking || !bytes.Equal(again.Bytes(), sigDisk.Bytes()) {
+		panic(fmt.Sprintf("chunked signature did not survive a round trip: %+v", read.Chunking()))
+	}
+	delta, stats := roundTripDelta(sigDisk.Bytes(), base, nil, changed, len(changed))
+	if stats.LiteralBytes > int64(len(changed))/4 || stats.WeakHits != 0 {
+		panic(fmt.Sprintf("chunked delta %v", stats))
+	}
+	for _, writeSize := range []int{7, 1000, 40000} {
+		if chunked, _ := roundTripDelta(sigDisk.Bytes(), base, nil, changed, writeSize); !bytes.Equal(chunked, delta) {
+			panic(fmt.Sprintf("chunked delta depends on %d byte writes", writeSize))
+		}
+	}
+	// a single large write is cut a maximum chunk at a time, not held whole
+	patchWriter, err := NewRsyncPatchWriterWithOptions(sigDisk.Bytes(), io.Discard, nil)
+	if err != nil {
+		panic(err)
+	}
+	if _, err = patchWriter.Write(changed); err != nil {
+		panic(err)
+	}
+	if cap(patchWriter.tail) > 2*opts.Chunking.Max {
+		panic(fmt.Sprintf("%d byte tail for a %d byte write", cap(patchWriter.tail), len(changed)))
+	}
+	var parallel bytes.Buffer
+	if _, err = WriteDeltaParallel(sigDisk.Bytes(), bytes.NewReader(changed), int64(len(changed)), &parallel, nil); err != nil {
+		panic(err)
+	}
+	if !bytes.Equal(parallel.Bytes(), delta) {
+		panic("parallel chunked delta differs")
+	}
+
+	if report, err := sig.Verify(bytes.NewReader(base)); err != nil || !report.OK() || report.FileBlocks != sig.BlockCount() {
+		panic(fmt.Sprintf("%+v %v", report, err))
+	}
+	if report, err := sig.Verify(bytes.NewReader(changed)); err != nil || report.OK() {
+		panic(fmt.Sprintf("%+v %v", report, err))
+	}
+
+	new_sig, err := NewSigFileContext(context.Background(), 0, changed, 8, &opts)
+	if err != nil {
+		panic(err)
+	}
+	cmp, err := CompareSignatures(&sig, &new_sig)
+	if err != nil {
+		panic(err)
+	}
+	if cmp.ChangedCount > new_sig.BlockCount()/4 || cmp.Estimate.InBytes != int64(len(changed)) {
+		panic(fmt.Sprintf("%+v", cmp))
+	}
+	fixed := NewSigFile(4096, changed, 8)
+	if _, err = CompareSignatures(&sig, &fixed); err == nil {
+		panic("chunked and fixed block signatures compared")
+	}
+	opts.Chunking.Max = opts.Chunking.Avg - 1
+	if _, err = NewSigFileContext(context.Background(), 0, base, 8, &opts); err == nil {
+		panic("chunking with a maximum below the average accepted")
+	}
+}
+
+func TestSigFileRegion(t *testing.T) {
+	base, _ := benchmarkFiles(100000)
+	region := Region{Offset: 30000, Length: 40000}
+	sig, err := NewSigFileRegion(context.Background(), 1024, base, region, 8, nil)
+	if err != nil {
+		panic(err)
+	}
+	var sigDisk bytes.Buffer
+	if err = sig.Serialize(&sigDisk); err != nil {
+		panic(err)
+	}
+	input := append(append([]byte("prefix"), base[region.Offset+500:region.End()]...), "suffix"...)
+	_, stats := roundTripDelta(sigDisk.Bytes(), base, &DeltaOptions{BasisOffset: region.Offset}, input, len(input))
+	if stats.LiteralBytes > 2048 {
+		panic(fmt.Sprintf("region delta %v", stats))
+	}
+	if _, err = NewSigFileRegion(context.Background(), 1024, base, Region{Offset: 90000, Length: 20000}, 8, nil); err == nil {
+		panic("region past the end of the basis signed")
+	}
+}
+
+func TestHierarchicalDelta(t *testing.T) {
+	base, _ := benchmarkFiles(4 << 20)
+	changed := append([]byte(nil), base...)
+	copy(changed[1000000:], "a few changed bytes")
+	changed = append(changed[:3000000], append([]byte("an insertion"), changed[3000000:]...)...)
+	changed = append(changed[:2000000], changed[2000100:]...)
+	delta, report, err := HierarchicalDelta(context.Background(), base, changed, &HierarchyOptions{CompareFlat: true})
+	if err != nil {
+		panic(err)
+	}
+	var finalOutput bytes.Buffer
+	if err = ApplyPatch(base, delta, &finalOutput); err != nil {
+		panic(err)
+	}
+	if !bytes.Equal(finalOutput.Bytes(), changed) {
+		panic("hierarchical delta round trip mismatch")
+	}
+	if len(report.Levels) != len(DEFAULT_HIERARCHY_BLOCK_SIZES) || report.Levels[0].RequestBytes != 0 ||
+		report.DeltaBytes != int64(len(delta)) || report.Delta.LiteralBytes > 4*256 {
+		panic(fmt.Sprintf("%+v", report))
+	}
+	if report.TotalBytes*4 > report.FlatTotalBytes() {
+		var text bytes.Buffer
+		_ = report.WriteText(&text)
+		panic(fmt.Sprintf("hierarchical sync saved too little:\n%s", text.String()))
+	}
+	// the flat comparison is only made when asked for
+	again, plain, err := HierarchicalDelta(context.Background(), base, changed, nil)
+	if err != nil {
+		panic(err)
+	}
+	if !bytes.Equal(again, delta) || plain.TotalBytes != report.TotalBytes || plain.FlatSigBytes != 0 || plain.FlatDeltaBytes != 0 {
+		panic(fmt.Sprintf("%+v", plain))
+	}
+}
+
+func TestBadSigArguments(t *testing.T) {
+	for _, test := range []struct {
+		block_size      uint32
+		crypto_sig_size uint32
+		opts            SigOptions
+	}{
+		{64, 17, SigOptions{}},
+		{0, 8, SigOptions{}},
+		{64, 8, SigOptions{Window: Region{Offset: 10, Length: int64(len(baseFile))}}},
+		{0, 8, SigOptions{Chunking: cdc.Params{Min: 100, Avg: 10, Max: 1000}}},
+	} {
+		if _, err := NewSigFileContext(context.Background(), test.block_size, baseFile, test.crypto_sig_size, &test.opts); err == nil {
+			panic(fmt.Sprintf("%+v accepted", test))
+		}
+		func() {
+			defer func() {
+				if recover() == nil {
+					panic(fmt.Sprintf("NewSigFileWithOptions returned a signature for %+v", test))
+				}
+			}()
+			NewSigFileWithOptions(test.block_size, baseFile, test.crypto_sig_size, &test.opts)
+		}()
+	}
+}
+
+func TestSignatureWindow(t *testing.T) {
+	base, _ := benchmarkFiles(1 << 20)
+	window := Region{Offset: 300000, Length: 200000}
+	changed := append([]byte(nil), base...)
+	copy(changed[350000:], "changed inside the window")
+	sig, err := NewSigFileContext(context.Background(), 1024, base, 8, &SigOptions{Window: window, Extended: true})
+	if err != nil {
+		panic(err)
+	}
+	if header, _ := sig.Header(); header.BasisLength != window.Length {
+		panic(fmt.Sprintf("basis length %d", header.BasisLength))
+	}
+	var sigDisk bytes.Buffer
+	if err = sig.Serialize(&sigDisk); err != nil {
+		panic(err)
+	}
+	var patchOut bytes.Buffer
+	patchWriter, err := NewRsyncPatchWriterWithOptions(sigDisk.Bytes(), &patchOut, nil)
+	if err != nil {
+		panic(err)
+	}
+	if got, ok := patchWriter.Window(); !ok || got != window {
+		panic(fmt.Sprintf("window %+v read back as %+v", window, got))
+	}
+	input, err := window.Section(bytes.NewReader(changed))
+	if err != nil {
+		panic(err)
+	}
+	if _, err = patchWriter.ReadFrom(input); err != nil {
+		panic(err)
+	}
+	if err = patchWriter.Close(); err != nil {
+		panic(err)
+	}
+	info, err := InspectDelta(patchOut.Bytes())
+	if err != nil {
+		panic(err)
+	}
+	for _, cmd := range info.Commands {
+		if cmd.Op == "COPY" && cmd.Basis+cmd.Length > window.Length {
+			panic(fmt.Sprintf("copy %+v leaves the window", cmd))
+		}
+	}
+	var finalOutput bytes.Buffer
+	if err = ApplyPatchWithOptions(base, patchOut.Bytes(), &finalOutput, &PatchOptions{BasisWindow: window}); err != nil {
+		panic(err)
+	}
+	if !bytes.Equal(finalOutput.Bytes(), changed[window.Offset:window.End()]) {
+		panic("window round trip mismatch")
+	}
+	short := PatchOptions{BasisWindow: Region{Offset: window.Offset, Length: 1000}}
+	if err = ApplyPatchWithOptions(base, patchOut.Bytes(), io.Discard, &short); err == nil {
+		panic("copy past the end of the window applied")
+	}
+
+	dir := t.TempDir()
+	if err = os.WriteFile(filepath.Join(dir, "basis"), base, 0666); err != nil {
+		panic(err)
+	}
+	basis, err := os.Open(filepath.Join(dir, "basis"))
+	if err != nil {
+		panic(err)
+	}
+	defer basis.Close()
+	output, err := os.Create(filepath.Join(dir, "output"))
+	if err != nil {
+		panic(err)
+	}
+	defer output.Close()
+	if err = ApplyPatchFile(basis, patchOut.Bytes(), output, &PatchOptions{BasisWindow: window}); err != nil {
+		panic(err)
+	}
+	if result, err := os.ReadFile(filepath.Join(dir, "output")); err != nil || !bytes.Equal(result, finalOutput.Bytes()) {
+		panic(fmt.Sprintf("file window round trip mismatch: %v", err))
+	}
+
+	if report, err := sig.Verify(bytes.NewReader(base)); err != nil || !report.OK() {
+		panic(fmt.Sprintf("%+v %v", report, err))
+	}
+	// a reader that can't seek is read up to the window
+	report, err := sig.Verify(io.MultiReader(bytes.NewReader(changed)))
+	if err != nil || len(report.Mismatches) != 1 || report.LengthChanged {
+		panic(fmt.Sprintf("%+v %v", report, err))
+	}
+	if _, err = NewSigFileContext(context.Background(), 1024, base, 8, &SigOptions{Window: Region{Offset: 1 << 20, Length: 1}}); err == nil {
+		panic("window past the end of the basis signed")
+	}
+}
+
+func TestMultiBasisDelta(t *testing.T) {
+	rng := rand.New(rand.NewSource(50))
+	part := func(size int) []byte {
+		data := make([]byte, size)
+		rng.Read(data)
+		return data
+	}
+	libA, libB, app, junk, added := part(200000), part(200000), part(100000), part(50000), part(5000)
+	concat := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	base0 := concat(app, libA)
+	base1 := concat(junk, libB)
+	changed := concat(libB, libA, added, app)
+	sigs := make([]BasisSignature, 2)
+	for index, base := range [][]byte{base1, base0} {
+		sig := NewSigFile(1024, base, 8)
+		var sigDisk bytes.Buffer
+		if err := sig.Serialize(&sigDisk); err != nil {
+			panic(err)
+		}
+		sigs[index] = BasisSignature{ID: 1 - index, Sig: sigDisk.Bytes()}
+	}
+	var patchOut bytes.Buffer
+	patchWriter, err := NewMultiBasisPatchWriter(sigs, &patchOut, nil)
+	if err != nil {
+		panic(err)
+	}
+	for data := changed; len(data) != 0; {
+		chunk := data[:min(len(data), 4000)]
+		if _, err = patchWriter.Write(chunk); err != nil {
+			panic(err)
+		}
+		data = data[len(chunk):]
+	}
+	if err = patchWriter.Close(); err != nil {
+		panic(err)
+	}
+	if stats := patchWriter.Stats(); stats.LiteralBytes > int64(len(added))+3*1024 {
+		panic(fmt.Sprintf("multi-basis delta %v", stats))
+	}
+	var finalOutput bytes.Buffer
+	bases := []io.ReaderAt{bytes.NewReader(base0), bytes.NewReader(base1)}
+	if err = ApplyPatchMulti(bases, patchOut.Bytes(), &finalOutput, nil); err != nil {
+		panic(err)
+	}
+	if !bytes.Equal(finalOutput.Bytes(), changed) {
+		panic("multi-basis round trip mismatch")
+	}
+	info, err := InspectDelta(patchOut.Bytes())
+	if err != nil {
+		panic(err)
+	}
+	var switches int
+	for _, cmd := range info.Commands {
+		if cmd.Op == "BASIS" {
+			switches += 1
+		}
+	}
+	// libB from basis 1, then libA and app from basis 0
+	if switches != 2 {
+		panic(fmt.Sprintf("%d basis commands, want 2", switches))
+	}
+	if err = ApplyPatch(base0, patchOut.Bytes(), io.Discard); err == nil {
+		panic("multi-basis delta applied to a single basis")
+	}
+	if err = ApplyPatchMulti(bases[:1], patchOut.Bytes(), io.Discard, nil); err == nil {
+		panic("multi-basis delta applied without its second basis")
+	}
+	if err = ApplyPatchMulti(bases, patchOut.Bytes(), io.Discard,
+		&PatchOptions{BasisWindow: Region{Offset: 10, Length: 1000}}); err == nil {
+		panic("multi-basis delta applied through a basis window")
+	}
+	// a plain delta copies from the first basis
+	sig := NewSigFile(1024, base0, 8)
+	var sigDisk bytes.Buffer
+	if err = sig.Serialize(&sigDisk); err != nil {
+		panic(err)
+	}
+	plain, _ := roundTripDelta(sigDisk.Bytes(), base0, nil, changed, len(changed))
+	finalOutput.Reset()
+	if err = ApplyPatchMulti(bases, plain, &finalOutput, nil); err != nil || !bytes.Equal(finalOutput.Bytes(), changed) {
+		panic(fmt.Sprintf("plain delta through ApplyPatchMulti: %v", err))
+	}
+
+	other := NewSigFile(2048, base1, 8)
+	var otherDisk bytes.Buffer
+	if err = other.Serialize(&otherDisk); err != nil {
+		panic(err)
+	}
+	if _, err = NewMultiBasisPatchWriter([]BasisSignature{sigs[1], {ID: 1, Sig: otherDisk.Bytes()}}, io.Discard, nil); err == nil {
+		panic("signatures with different block sizes combined")
+	}
+	if _, err = NewMultiBasisPatchWriter([]BasisSignature{sigs[0], {ID: 1, Sig: sigs[1].Sig}}, io.Discard, nil); err == nil {
+		panic("repeated basis id accepted")
+	}
+}
+
+func TestAlignedDelta(t *testing.T) {
+	base, changed, inserted := inPlaceFiles(1 << 20)
+	sig := NewSigFile(1024, base, 8)
+	var sigDisk bytes.Buffer
+	if err := sig.Serialize(&sigDisk); err != nil {
+		panic(err)
+	}
+	delta := func(opts *DeltaOptions, input []byte, writeSize int) ([]byte, DeltaStats) {
+		return roundTripDelta(sigDisk.Bytes(), base, opts, input, writeSize)
+	}
+	_, rolling := delta(nil, changed, len(changed))
+	aligned, stats := delta(&DeltaOptions{Aligned: true}, changed, len(changed))
+	if stats.LiteralBytes != rolling.LiteralBytes || stats.WeakHits >= rolling.WeakHits+int64(len(sig.signatures)) {
+		panic(fmt.Sprintf("aligned %v\nrolling %v", stats, rolling))
+	}
+	for _, writeSize := range []int{7, 1000, 1025} {
+		if chunked, _ := delta(&DeltaOptions{Aligned: true}, changed, writeSize); !bytes.Equal(chunked, aligned) {
+			panic(fmt.Sprintf("aligned delta depends on %d byte writes", writeSize))
+		}
+	}
+	// an insertion shifts everything after it off the block grid
+	_, stats = delta(&DeltaOptions{Aligned: true}, inserted, len(inserted))
+	if stats.LiteralBytes < int64(len(inserted))/2 {
+		panic(fmt.Sprintf("aligned matched shifted data: %v", stats))
+	}
+	_, stats = delta(&DeltaOptions{Aligned: true, RollAfterMiss: 1024}, inserted, 4096)
+	if stats.LiteralBytes > int64(len(inserted))/8 {
+		panic(fmt.Sprintf("rolling after a miss did not resync: %v", stats))
+	}
+	_, stats = delta(&DeltaOptions{Aligned: true, MaxLiteralRun: 1000}, inserted, len(inserted))
+	if stats.LiteralBytes > stats.LiteralCmds*1000 {
+		panic(fmt.Sprintf("literal runs longer than 1000 bytes: %v", stats))
+	}
+	// skipping to the next aligned window must not carry literals past the cap
+	sig = NewSigFile(2048, base, 8)
+	sigDisk.Reset()
+	if err := sig.Serialize(&sigDisk); err != nil {
+		panic(err)
+	}
+	for _, zeroRuns := range []bool{false, true} {
+		opts := &DeltaOptions{Aligned: true, RollAfterMiss: 222, MaxLiteralRun: 1236, ZeroRuns: zeroRuns}
+		for _, input := range [][]byte{changed, inserted} {
+			patch, _ := delta(opts, input, 4096)
+			deltaInfo, err := InspectDelta(patch)
+			if err != nil {
+				panic(err)
+			}
+			for _, cmd := range deltaInfo.Commands {
+				if cmd.Op == "LITERAL" && cmd.Length > 1236 {
+					panic(fmt.Sprintf("%+v: literal run of %d bytes", opts, cmd.Length))
+				}
+			}
+		}
+	}
+}
+
+func TestInspect(t *testing.T) {
+	sig := NewSigFile(11, baseFile, 8)
+	var sigDisk bytes.Buffer
+	err := sig.Serialize(&sigDisk)
+	if err != nil {
+		panic(err)
+	}
+	sigInfo, err := InspectSignature(sigDisk.Bytes())
+	if err != nil {
+		panic(err)
+	}
+	if sigInfo.BlockSize != 11 || sigInfo.StrongLength != 8 ||
+		sigInfo.BlockCount != (len(baseFile)+10)/11 || len(sigInfo.Blocks) != sigInfo.BlockCount {
+		panic(fmt.Sprintf("bad signature info %+v", sigInfo))
+	}
+	var patchOut bytes.Buffer
+	patchWriter, perr := NewRsyncPatchWriter(sigDisk.Bytes(), &patchOut)
+	if perr != nil {
+		panic(perr)
+	}
+	_, err = patchWriter.Write(changedFile)
+	if err != nil {
+		panic(err)
+	}
+	err = patchWriter.Close()
+	if err != nil {
+		panic(err)
+	}
+	deltaInfo, err := InspectDelta(patchOut.Bytes())
+	if err != nil {
+		panic(err)
+	}
+	if deltaInfo.LiteralBytes+deltaInfo.CopyBytes != int64(len(changedFile)) {
+		panic(fmt.Sprintf("delta covers %d bytes, not %d",
+			deltaInfo.LiteralBytes+deltaInfo.CopyBytes, len(changedFile)))
+	}
+	last := deltaInfo.Commands[len(deltaInfo.Commands)-1]
+	if last.Op != "END" || last.Target != int64(len(changedFile)) {
+		panic(fmt.Sprintf("bad final command %+v", last))
+	}
+	var text bytes.Buffer
+	if err = deltaInfo.WriteText(&text); err != nil {
+		panic(err)
+	}
+	if err = sigInfo.WriteJSON(&text); err != nil {
+		panic(err)
+	}
+	// every copy, including one from offset 0, shows its basis offset and
+	// nothing else does
+	var deltaJSON bytes.Buffer
+	if err = deltaInfo.WriteJSON(&deltaJSON); err != nil {
+		panic(err)
+	}
+	var decoded struct {
+		Commands []map[string]interface{} `json:"commands"`
+	}
+	if err = json.Unmarshal(deltaJSON.Bytes(), &decoded); err != nil {
+		panic(err)
+	}
+	for index, cmd := range decoded.Commands {
+		if _, ok := cmd["basis"]; ok != (cmd["op"] == "COPY") {
+			panic(fmt.Sprintf("command %d: %v", index, cmd))
+		}
+	}
+	first, err := json.Marshal(DeltaCommandInfo{Op: "COPY", Length: 11})
+	if err != nil || !bytes.Contains(first, []byte(`"basis":0`)) {
+		panic(fmt.Sprintf("copy from offset 0 is %s: %v", first, err))
+	}
+}
+
+func TestDeltaStats(t *testing.T) {
+	sig := NewSigFile(11, baseFile, 8)
+	var sigDisk bytes.Buffer
+	err := sig.Serialize(&sigDisk)
+	if err != nil {
+		panic(err)
+	}
+	var patchOut bytes.Buffer
+	patchWriter, perr := NewRsyncPatchWriter(sigDisk.Bytes(), &patchOut)
+	if perr != nil {
+		panic(perr)
+	}
+	_, err = patchWriter.Write(changedFile)
+	if err != nil {
+		panic(err)
+	}
+	err = patchWriter.Close()
+	if err != nil {
+		panic(err)
+	}
+	stats := patchWriter.Stats()
+	deltaInfo, err := InspectDelta(patchOut.Bytes())
+	if err != nil {
+		panic(err)
+	}
+	if stats.LiteralBytes != deltaInfo.LiteralBytes || stats.CopyBytes != deltaInfo.CopyBytes ||
+		stats.LiteralCmds+stats.CopyCmds != int64(len(deltaInfo.Commands)-1) {
+		panic(fmt.Sprintf("stats %v disagree with delta %+v", stats, deltaInfo))
+	}
+	if stats.InBytes != int64(len(changedFile)) || stats.WeakHits < stats.CopyCmds ||
+		stats.SigBlocks != len(sig.signatures) {
+		panic(stats.String())
+	}
+	if stats.OutBytes()+int64(len(DeltaMagic))+1 != int64(patchOut.Len()) {
+		panic(fmt.Sprintf("%d out bytes for a %d byte delta", stats.OutBytes(), patchOut.Len()))
+	}
+}
+
+func TestProgress(t *testing.T) {
+	var reports []Progress
+	observe := func(progress Progress) {
+		reports = append(reports, progress)
+	}
+	sig := NewSigFileWithOptions(11, baseFile, 8, &SigOptions{Progress: observe, ProgressInterval: 100})
+	var sigDisk bytes.Buffer
+	err := sig.Serialize(&sigDisk)
+	if err != nil {
+		panic(err)
+	}
+	var patchOut bytes.Buffer
+	patchWriter, perr := NewRsyncPatchWriterWithOptions(sigDisk.Bytes(), &patchOut, &DeltaOptions{
+		Progress: observe, ProgressInterval: 100, InputSize: int64(len(changedFile)),
+	})
+	if perr != nil {
+		panic(perr)
+	}
+	_, err = patchWriter.Write(changedFile)
+	if err != nil {
+		panic(err)
+	}
+	err = patchWriter.Close()
+	if err != nil {
+		panic(err)
+	}
+	var finalOutput bytes.Buffer
+	err = ApplyPatchWithOptions(baseFile, patchOut.Bytes(), &finalOutput, &PatchOptions{
+		Progress: observe, ProgressInterval: 100,
+	})
+	if err != nil {
+		panic(err)
+	}
+	if !bytes.Equal(finalOutput.Bytes(), changedFile) {
+		panic("progress changed the patch")
+	}
+	totals := map[ProgressPhase]int64{
+		PhaseSignature: int64(len(baseFile)),
+		PhaseDelta:     int64(len(changedFile)),
+		PhasePatch:     int64(patchOut.Len()),
+	}
+	last := map[ProgressPhase]Progress{}
+	for _, report := range reports {
+		if report.Done < last[report.Phase].Done || report.Total != totals[report.Phase] {
+			panic(fmt.Sprintf("bad progress report %+v", report))
+		}
+		last[report.Phase] = report
+	}
+	for phase, total := range totals {
+		if last[phase].Done != total {
+			panic(fmt.Sprintf("%v finished at %d of %d", phase, last[phase].Done, total))
+		}
+	}
+	if len(reports) < 10 {
+		panic(fmt.Sprintf("only %d progress reports", len(reports)))
+	}
+}
+
+func TestContextCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := NewSigFileContext(ctx, 11, baseFile, 8, nil)
+	if err != context.Canceled {
+		panic(fmt.Sprintf("signature not cancelled: %v", err))
+	}
+	sig := NewSigFile(11, baseFile, 8)
+	var sigDisk bytes.Buffer
+	err = sig.Serialize(&sigDisk)
+	if err != nil {
+		panic(err)
+	}
+	var patchOut bytes.Buffer
+	patchWriter, perr := NewRsyncPatchWriter(sigDisk.Bytes(), &patchOut)
+	if perr != nil {
+		panic(perr)
+	}
+	_, err = patchWriter.WriteContext(context.Background(), changedFile[:200])
+	if err != nil {
+		panic(err)
+	}
+	_, err = patchWriter.WriteContext(ctx, changedFile[200:])
+	if err != context.Canceled {
+		panic(fmt.Sprintf("delta not cancelled: %v", err))
+	}
+	if patchWriter.Close() != context.Canceled {
+		panic("cancelled delta closed cleanly")
+	}
+	var finalOutput bytes.Buffer
+	if ApplyPatch(baseFile, patchOut.Bytes(), &finalOutput) == nil {
+		panic("cancelled delta applied cleanly")
+	}
+
+	patchOut.Reset()
+	patchWriter, perr = NewRsyncPatchWriter(sigDisk.Bytes(), &patchOut)
+	if perr != nil {
+		panic(perr)
+	}
+	_, err = patchWriter.WriteContext(context.Background(), changedFile)
+	if err != nil {
+		panic(err)
+	}
+	err = patchWriter.CloseContext(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	finalOutput.Reset()
+	err = ApplyPatchContext(ctx, baseFile, patchOut.Bytes(), &finalOutput, nil)
+	if err != context.Canceled || finalOutput.Len() != 0 {
+		panic(fmt.Sprintf("patch not cancelled: %v", err))
+	}
+	err = ApplyPatchContext(context.Background(), baseFile, patchOut.Bytes(), &finalOutput, nil)
+	if err != nil {
+		panic(err)
+	}
+	if !bytes.Equal(finalOutput.Bytes(), changedFile) {
+		panic("context patch differs")
+	}
+}
+
+func TestBoundedLiteralRuns(t *testing.T) {
+	newFile := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(newFile)
+	zeros := 32768
+	clear(newFile[zeros : 2*zeros])
+	// with ZeroRuns the input is read from a file with a hole where the zeros
+	// are, and with 4096 byte blocks the unmatched tail left for Close or
+	// before the hole is longer than the cap
+	sparseFile, err := os.Create(filepath.Join(t.TempDir(), "input"))
+	if err != nil {
+		panic(err)
+	}
+	defer sparseFile.Close()
+	if _, err = sparseFile.Write(newFile[:zeros]); err != nil {
+		panic(err)
+	}
+	if _, err = sparseFile.WriteAt(newFile[2*zeros:], int64(2*zeros)); err != nil {
+		panic(err)
+	}
+	for _, test := range []struct {
+		blockSize uint32
+		zeroRuns  bool
+	}{{64, false}, {4096, false}, {64, true}, {4096, true}} {
+		blockSize := test.blockSize
+		sig := NewSigFile(blockSize, baseFile, 8)
+		var sigDisk bytes.Buffer
+		err = sig.Serialize(&sigDisk)
+		if err != nil {
+			panic(err)
+		}
+		var patchOut bytes.Buffer
+		patchWriter, perr := NewRsyncPatchWriterWithOptions(sigDisk.Bytes(), &patchOut, &DeltaOptions{
+			MaxLiteralRun: 1000,
+			ZeroRuns:      test.zeroRuns,
+		})
+		if perr != nil {
+			panic(perr)
+		}
+		if test.zeroRuns {
+			if _, err = sparseFile.Seek(0, io.SeekStart); err != nil {
+				panic(err)
+			}
+			_, err = patchWriter.ReadFrom(sparseFile)
+		} else {
+			_, err = patchWriter.Write(newFile)
+		}
+		if err != nil {
+			panic(err)
+		}
+		if patchOut.Len() < len(newFile)-zeros-1000-int(blockSize) {
+			panic(fmt.Sprintf("only %d bytes of delta streamed before Close", patchOut.Len()))
+		}
+		err = patchWriter.Close()
+		if err != nil {
+			panic(err)
+		}
+		deltaInfo, err := InspectDelta(patchOut.Bytes())
+		if err != nil {
+			panic(err)
+		}
+		for _, cmd := range deltaInfo.Commands {
+			if cmd.Op == "LITERAL" && cmd.Length > 1000 {
+				panic(fmt.Sprintf("%+v: literal run of %d bytes", test, cmd.Length))
+			}
+		}
+		var finalOutput bytes.Buffer
+		err = ApplyPatch(baseFile, patchOut.Bytes(), &finalOutput)
+		if err != nil {
+			panic(err)
+		}
+		if !bytes.Equal(finalOutput.Bytes(), newFile) {
+			panic("bounded literal delta differs")
+		}
+	}
+}
+
+// benchmarkFiles returns a pseudo random basis and a copy of it with scattered
+// insertions, deletions and overwrites
+func benchmarkFiles(size int) ([]byte, []byte) {
+	rng := rand.New(rand.NewSource(int64(size)))
+	base := make([]byte, size)
+	rng.Read(base)
+	var changed []byte
+	for pos := 0; pos < len(base); {
+		run := min(len(base)-pos, rng.Intn(64*1024))
+		changed = append(changed, base[pos:pos+run]...)
+		pos += run
+		edit := make([]byte, rng.Intn(100))
+		rng.Read(edit)
+		switch rng.Intn(3) {
+		case 0:
+			changed = append(changed, edit...)
+		case 1:
+			pos += len(edit)
+		default:
+			changed = append(changed, edit...)
+			pos += len(edit)
+		}
+	}
+	return base, changed
+}
+
+func benchmarkDelta(b *testing.B, size int, writeSize int) {
+	base, changed := benchmarkFiles(size)
+	sig := NewSigFile(2048, base, 8)
+	var sigDisk bytes.Buffer
+	err := sig.Serialize(&sigDisk)
+	if err != nil {
+		panic(err)
+	}
+	b.SetBytes(int64(len(changed)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var patchOut bytes.Buffer
+		patchWriter, perr := NewRsyncPatchWriter(sigDisk.Bytes(), &patchOut)
+		if perr != nil {
+			panic(perr)
+		}
+		for data := changed; len(data) != 0; {
+			chunk := data[:min(len(data), writeSize)]
+			if _, err = patchWriter.Write(chunk); err != nil {
+				panic(err)
+			}
+			data = data[len(chunk):]
+		}
+		if err = patchWriter.Close(); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func BenchmarkDelta(b *testing.B) {
+	benchmarkDelta(b, 8<<20, 8<<20)
+}
+
+func BenchmarkDeltaSmallWrites(b *testing.B) {
+	benchmarkDelta(b, 8<<20, 32*1024)
+}
+
+// BenchmarkDeltaAligned compares rolling and aligned matching on the same
+// files changed in place: one with a few small edits, where both mostly skip
+// from one matched block to the next, and one with every other block
+// rewritten, where rolling has to test every offset of each missed block
+func BenchmarkDeltaAligned(b *testing.B) {
+	base, changed, _ := inPlaceFiles(8 << 20)
+	rewritten := append([]byte{}, base...)
+	rng := rand.New(rand.NewSource(4))
+	for pos := 0; pos < len(rewritten); pos += 2 * 4096 {
+		rng.Read(rewritten[pos : pos+4096])
+	}
+	sig := NewSigFile(4096, base, 8)
+	var sigDisk bytes.Buffer
+	if err := sig.Serialize(&sigDisk); err != nil {
+		panic(err)
+	}
+	for _, input := range []struct {
+		name string
+		data []byte
+	}{{"edits", changed}, {"rewritten", rewritten}} {
+		for _, aligned := range []bool{false, true} {
+			name := input.name + "/rolling"
+			if aligned {
+				name = input.name + "/aligned"
+			}
+			b.Run(name, func(b *testing.B) {
+				b.SetBytes(int64(len(input.data)))
+				for i := 0; i < b.N; i++ {
+					patchWriter, err := NewRsyncPatchWriterWithOptions(sigDisk.Bytes(), io.Discard,
+						&DeltaOptions{Aligned: aligned})
+					if err != nil {
+						panic(err)
+					}
+					if _, err = patchWriter.Write(input.data); err != nil {
+						panic(err)
+					}
+					if err = patchWriter.Close(); err != nil {
+						panic(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkDeltaNoMatches(b *testing.B) {
+	base, _ := benchmarkFiles(8 << 20)
+	_, changed := benchmarkFiles(8<<20 + 1)
+	sig := NewSigFile(2048, base, 8)
+	var sigDisk bytes.Buffer
+	err := sig.Serialize(&sigDisk)
+	if err != nil {
+		panic(err)
+	}
+	b.SetBytes(int64(len(changed)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		patchWriter, perr := NewRsyncPatchWriter(sigDisk.Bytes(), io.Discard)
+		if perr != nil {
+			panic(perr)
+		}
+		if _, err = patchWriter.Write(changed); err != nil {
+			panic(err)
+		}
+		if err = patchWriter.Close(); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func TestDeltaIndependentOfWriteSizes(t *testing.T) {
+	base, changed := benchmarkFiles(200000)
+	for _, block_size := range []uint32{1, 5, 64, 2048} {
+		sig := NewSigFile(block_size, base, 8)
+		var sigDisk bytes.Buffer
+		err := sig.Serialize(&sigDisk)
+		if err != nil {
+			panic(err)
+		}
+		var reference []byte
+		for _, writeSize := range []int{len(changed), 1, 3, 4095, 70000} {
+			var patchOut bytes.Buffer
+			patchWriter, perr := NewRsyncPatchWriter(sigDisk.Bytes(), &patchOut)
+			if perr != nil {
+				panic(perr)
+			}
+			for data := changed; len(data) != 0; {
+				chunk := data[:min(len(data), writeSize)]
+				if _, err = patchWriter.Write(chunk); err != nil {
+					panic(err)
+				}
+				data = data[len(chunk):]
+			}
+			if err = patchWriter.Close(); err != nil {
+				panic(err)
+			}
+			if reference == nil {
+				reference = patchOut.Bytes()
+				var finalOutput bytes.Buffer
+				err = ApplyPatch(base, reference, &finalOutput)
+				if err != nil {
+					panic(err)
+				}
+				if !bytes.Equal(finalOutput.Bytes(), changed) {
+					panic(fmt.Sprintf("block size %d patch differs", block_size))
+				}
+			} else if !bytes.Equal(reference, patchOut.Bytes()) {
+				panic(fmt.Sprintf("block size %d: %d byte writes change the delta", block_size, writeSize))
+			}
+		}
+	}
+}
+
+func TestDeltaMatchesShortFinalBlock(t *testing.T) {
+	sig := NewSigFile(64, baseFile, 8)
+	var sigDisk bytes.Buffer
+	err := sig.Serialize(&sigDisk)
+	if err != nil {
+		panic(err)
+	}
+	var patchOut bytes.Buffer
+	patchWriter, perr := NewRsyncPatchWriter(sigDisk.Bytes(), &patchOut)
+	if perr != nil {
+		panic(perr)
+	}
+	_, err = patchWriter.Write(baseFile)
+	if err != nil {
+		panic(err)
+	}
+	if err = patchWriter.Close(); err != nil {
+		panic(err)
+	}
+	if stats := patchWriter.Stats(); stats.LiteralBytes != 0 {
+		panic(fmt.Sprintf("identical file sent literals: %v", stats))
+	}
+}
+
+func TestParallelDeltaMatchesSerial(t *testing.T) {
+	base, changed := benchmarkFiles(300000)
+	for _, block_size := range []uint32{7, 64, 2048} {
+		sig := NewSigFile(block_size, base, 8)
+		var sigDisk bytes.Buffer
+		err := sig.Serialize(&sigDisk)
+		if err != nil {
+			panic(err)
+		}
+		for _, input := range [][]byte{changed, base, changed[:len(changed)-len(changed)%20000+3], baseFile} {
+			var serial bytes.Buffer
+			patchWriter, perr := NewRsyncPatchWriterWithOptions(sigDisk.Bytes(), &serial, &DeltaOptions{MaxLiteralRun: 5000})
+			if perr != nil {
+				panic(perr)
+			}
+			if _, err = patchWriter.Write(input); err != nil {
+				panic(err)
+			}
+			if err = patchWriter.Close(); err != nil {
+				panic(err)
+			}
+			for _, segment_size := range []int64{1, 20000, 65536, 1 << 30} {
+				var parallel bytes.Buffer
+				stats, err := WriteDeltaParallel(sigDisk.Bytes(), bytes.NewReader(input), int64(len(input)), &parallel,
+					&DeltaOptions{MaxLiteralRun: 5000, Parallelism: 3, SegmentSize: segment_size})
+				if err != nil {
+					panic(err)
+				}
+				if !bytes.Equal(serial.Bytes(), parallel.Bytes()) {
+					panic(fmt.Sprintf("block size %d segment size %d: parallel delta differs", block_size, segment_size))
+				}
+				// the parallel scan ignores AppendOnly
+				parallel.Reset()
+				_, err = WriteDeltaParallel(sigDisk.Bytes(), bytes.NewReader(input), int64(len(input)), &parallel,
+					&DeltaOptions{MaxLiteralRun: 5000, Parallelism: 3, SegmentSize: segment_size, AppendOnly: true})
+				if err != nil {
+					panic(err)
+				}
+				if !bytes.Equal(serial.Bytes(), parallel.Bytes()) {
+					panic(fmt.Sprintf("block size %d segment size %d: append-only parallel delta differs", block_size, segment_size))
+				}
+				if stats.InBytes != int64(len(input)) || stats.CopyBytes != patchWriter.Stats().CopyBytes {
+					panic(stats.String())
+				}
+				// the windows rescanned after a boundary are counted once, as serially
+				if stats.WeakHits != patchWriter.Stats().WeakHits || stats.FalseMatches != patchWriter.Stats().FalseMatches {
+					panic(fmt.Sprintf("segment size %d: %d weak hits against %d", segment_size, stats.WeakHits, patchWriter.Stats().WeakHits))
+				}
+			}
+		}
+	}
+	// a file that grew past a one block basis is still searched, not matched
+	// as an append
+	short := NewSigFile(64, baseFile[:50], 8)
+	var shortDisk bytes.Buffer
+	if err := short.Serialize(&shortDisk); err != nil {
+		panic(err)
+	}
+	grown := append(append([]byte{}, baseFile[:50]...), "appended"...)
+	serial, _ := roundTripDelta(shortDisk.Bytes(), baseFile[:50], nil, grown, len(grown))
+	var parallel bytes.Buffer
+	if _, err := WriteDeltaParallel(shortDisk.Bytes(), bytes.NewReader(grown), int64(len(grown)), &parallel,
+		&DeltaOptions{AppendOnly: true}); err != nil {
+		panic(err)
+	}
+	if !bytes.Equal(serial, parallel.Bytes()) {
+		panic("append-only parallel delta of a one block basis differs")
+	}
+}
+
+func BenchmarkDeltaParallel(b *testing.B) {
+	base, changed := benchmarkFiles(32 << 20)
+	sig := NewSigFile(2048, base, 8)
+	var sigDisk bytes.Buffer
+	err := sig.Serialize(&sigDisk)
+	if err != nil {
+		panic(err)
+	}
+	b.SetBytes(int64(len(changed)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err = WriteDeltaParallel(sigDisk.Bytes(), bytes.NewReader(changed), int64(len(changed)), io.Discard,
+			&DeltaOptions{SegmentSize: 4 << 20})
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// writerOnly hides every method but Write so io.Copy falls back to Read
+type writerOnly struct {
+	io.Writer
+}
+
+func TestCopyPlumbing(t *testing.T) {
+	sig := NewSigFile(11, baseFile, 8)
+	var serialized, written bytes.Buffer
+	err := sig.Serialize(&serialized)
+	if err != nil {
+		panic(err)
+	}
+	n, err := sig.WriteTo(&written)
+	if err != nil {
+		panic(err)
+	}
+	if n != int64(written.Len()) || !bytes.Equal(serialized.Bytes(), written.Bytes()) {
+		panic("WriteTo differs from Serialize")
+	}
+	var patchOut bytes.Buffer
+	patchWriter, perr := NewRsyncPatchWriter(serialized.Bytes(), &patchOut)
+	if perr != nil {
+		panic(perr)
+	}
+	n, err = io.Copy(patchWriter, bytes.NewReader(changedFile))
+	if err != nil || n != int64(len(changedFile)) {
+		panic(fmt.Sprintf("copied %d: %v", n, err))
+	}
+	if err = patchWriter.Close(); err != nil {
+		panic(err)
+	}
+	for _, output := range []func(*bytes.Buffer) io.Writer{
+		func(buf *bytes.Buffer) io.Writer { return buf },
+		func(buf *bytes.Buffer) io.Writer { return writerOnly{buf} },
+	} {
+		reconstruction, err := NewPatch(baseFile, patchOut.Bytes(), nil)
+		if err != nil {
+			panic(err)
+		}
+		var finalOutput bytes.Buffer
+		n, err = io.Copy(output(&finalOutput), reconstruction)
+		if err != nil || n != int64(len(changedFile)) {
+			panic(fmt.Sprintf("copied %d: %v", n, err))
+		}
+		if !bytes.Equal(finalOutput.Bytes(), changedFile) {
+			panic("copied patch differs")
+		}
+	}
+}
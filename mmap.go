@@ -0,0 +1,74 @@
+//
+// Copyright 2018 Daniel Reiter Horn
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS
+// OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rsync
+
+import (
+	"io"
+	"os"
+)
+
+// MappedFile is a read-only view of a whole file. On Linux regular files are
+// memory mapped so that huge signatures and bases stay in the page cache
+// rather than the Go heap; elsewhere, and for anything that can't be mapped,
+// the file is read into memory instead. Bytes may be handed to
+// DeserializeSigFileView, NewRsyncPatchWriter or ApplyPatch, but neither it nor
+// anything made from it may be used after Close.
+type MappedFile struct {
+	data   []byte
+	mapped bool
+}
+
+// MapFile opens name and maps or reads it whole
+func MapFile(name string) (*MappedFile, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if data, ok, err := mapFile(file); ok || err != nil {
+		return &MappedFile{data: data, mapped: ok}, err
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return &MappedFile{data: data}, nil
+}
+
+func (self *MappedFile) Bytes() []byte {
+	return self.data
+}
+
+// Mapped is true if the contents are memory mapped rather than read
+func (self *MappedFile) Mapped() bool {
+	return self.mapped
+}
+
+func (self *MappedFile) Close() error {
+	data, mapped := self.data, self.mapped
+	self.data, self.mapped = nil, false
+	if mapped {
+		return unmapFile(data)
+	}
+	return nil
+}
@@ -19,41 +19,39 @@
 // DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
 // WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
 // WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build linux
+
 package rsync
 
-const CRC_MAGIC_16 uint16 = 31
-const CRC_MAGIC uint32 = uint32(CRC_MAGIC_16)
+import (
+	"errors"
+	"os"
 
-func crcRollout(sum uint32, size uint32, old_byte_u8 byte) uint32 {
-	size_16 := uint16(size)
-	old_byte := uint16(old_byte_u8)
-	s1 := uint16(sum & 0xffff)
-	s2 := uint16(sum >> 16)
-	s1 = s1 - (old_byte + CRC_MAGIC_16)
-	s2 = s2 - (size_16 * uint16(old_byte+CRC_MAGIC_16))
-	return uint32(s1) | (uint32(s2) << 16)
-}
+	"golang.org/x/sys/unix"
+)
 
-func crcRotate(sum uint32, size uint32, old_byte_u8 byte, new_byte_u8 byte) uint32 {
-	size_16 := uint16(size)
-	old_byte := uint16(old_byte_u8)
-	new_byte := uint16(new_byte_u8)
-	s1 := uint16(sum & 0xffff)
-	s2 := uint16(sum >> 16)
-	s1 = s1 + (new_byte - old_byte)
-	s2 = s2 + (s1 - (size_16 * (old_byte + CRC_MAGIC_16)))
-	return uint32(s1) | (uint32(s2) << 16)
+// mapFile maps file if it is a regular, non-empty file, reporting false if it
+// should be read instead
+func mapFile(file *os.File) ([]byte, bool, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	if !info.Mode().IsRegular() || info.Size() == 0 {
+		return nil, false, nil
+	}
+	if info.Size() != int64(int(info.Size())) {
+		return nil, false, errors.New("File too large to map")
+	}
+	data, err := unix.Mmap(int(file.Fd()), 0, int(info.Size()), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		// some filesystems can't be mapped; reading still works
+		return nil, false, nil
+	}
+	return data, true, nil
 }
 
-func crcUpdate(sum uint32, buf []byte) uint32 {
-	s1 := uint16(sum & 0xffff)
-	s2 := uint16(sum >> 16)
-	for _, item := range buf {
-		s1 = s1 + uint16(item)
-		s2 = s2 + s1
-	}
-	len := uint32(len(buf))
-	s1 = s1 + uint16(len*CRC_MAGIC)
-	s2 = s2 + uint16(((len*(len+1))/2)*CRC_MAGIC)
-	return uint32(s1) | (uint32(s2) << 16)
+func unmapFile(data []byte) error {
+	return unix.Munmap(data)
 }
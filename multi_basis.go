@@ -0,0 +1,195 @@
+//
+// Copyright 2018 Daniel Reiter Horn
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS
+// OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// BasisSignature is the on-disk signature of one basis of a multi-basis
+// delta. ID is the basis' index in the list given to ApplyPatchMulti.
+type BasisSignature struct {
+	ID  int
+	Sig []byte
+}
+
+// basisSpan is the range of a multi-basis signature's offsets that one
+// basis' blocks take up
+type basisSpan struct {
+	id    int
+	start int64
+	end   int64
+}
+
+// NewMultiBasisPatchWriter is NewRsyncPatchWriterWithOptions matching the new
+// file against several bases at once, so that content which moved between
+// files is copied rather than sent again. The signatures must share their
+// block size, strong hash and length, seed and chunking. Their blocks are
+// searched together and each copy is preceded, where the basis changes, by a
+// basis command naming the one it reads from; only ApplyPatchMulti applies
+// such deltas. The short final block of a fixed-size signature can only be
+// matched in the last signature. AppendOnly and BasisOffset are ignored.
+func NewMultiBasisPatchWriter(sigs []BasisSignature, output io.Writer, opts *DeltaOptions) (*RsyncPatchWriter, error) {
+	if len(sigs) == 0 {
+		return nil, errors.New("No signatures to match against")
+	}
+	var combined SigFile
+	var bases []basisSpan
+	var offset int64
+	seen := map[int]bool{}
+	for index, item := range sigs {
+		if item.ID < 0 || seen[item.ID] {
+			return nil, fmt.Errorf("Basis id %d is negative or repeated", item.ID)
+		}
+		seen[item.ID] = true
+		sig, err := DeserializeSigFileView(item.Sig)
+		if err != nil {
+			return nil, err
+		}
+		if index == 0 {
+			combined = SigFile{
+				block_size:       sig.block_size,
+				crypto_hash_size: sig.crypto_hash_size,
+				hash:             sig.hash,
+				seed:             sig.seed,
+				chunking:         sig.chunking,
+			}
+		} else if sig.block_size != combined.block_size || sig.crypto_hash_size != combined.crypto_hash_size ||
+			sig.Hash() != combined.Hash() || !bytes.Equal(sig.seed, combined.seed) || sig.chunking != combined.chunking {
+			return nil, fmt.Errorf("Signature of basis %d doesn't match the others' block size, strong sum, seed or chunking", item.ID)
+		}
+		offsets := sig.offsets()
+		bases = append(bases, basisSpan{id: item.ID, start: offset, end: offset + offsets[len(offsets)-1]})
+		offset += offsets[len(offsets)-1]
+		combined.signatures = append(combined.signatures, sig.signatures...)
+	}
+	var local DeltaOptions
+	if opts != nil {
+		local = *opts
+	}
+	local.AppendOnly = false
+	local.BasisOffset = 0
+	writer, err := newRsyncPatchWriter(combined, output, &local)
+	if err != nil {
+		return nil, err
+	}
+	writer.bases = bases
+	return writer, nil
+}
+
+func select_basis_command(id int) []byte {
+	var output [9]byte
+	logLenNumBytes := writeVarInt(id, output[1:])
+	output[0] = RS_OP_BASIS_N1 + byte(logLenNumBytes)
+	return output[:1+(1<<logLenNumBytes)]
+}
+
+// emit_basis_copy writes a copy of the combined signature's offsets as copies
+// of the bases they fall in, switching bases as needed
+func (self *RsyncPatchWriter) emit_basis_copy(where int, xlen int) error {
+	for xlen != 0 {
+		index := sort.Search(len(self.bases), func(index int) bool {
+			return self.bases[index].end > int64(where)
+		})
+		span := self.bases[index]
+		length := min(xlen, int(span.end)-where)
+		if span.id != self.current_basis {
+			cmd := select_basis_command(span.id)
+			self.stats.CopyCmdBytes += int64(len(cmd))
+			if _, err := self.output.Write(cmd); err != nil {
+				return err
+			}
+			self.current_basis = span.id
+		}
+		if err := self.write_copy(where-int(span.start), length); err != nil {
+			return err
+		}
+		where += length
+		xlen -= length
+	}
+	return nil
+}
+
+// ApplyPatchMulti applies a delta from NewMultiBasisPatchWriter, reading every
+// copy from the basis its basis command picked out of bases. A plain delta
+// copies from bases[0]. opts can't set a BasisWindow; pass each basis as an
+// io.SectionReader of its window instead.
+func ApplyPatchMulti(bases []io.ReaderAt, patch []byte, output io.Writer, opts *PatchOptions) error {
+	return ApplyPatchMultiContext(context.Background(), bases, patch, output, opts)
+}
+
+// ApplyPatchMultiContext is ApplyPatchMulti checking ctx before every command
+func ApplyPatchMultiContext(ctx context.Context, bases []io.ReaderAt, patch []byte, output io.Writer, opts *PatchOptions) error {
+	if len(bases) == 0 {
+		return errors.New("No bases to copy from")
+	}
+	if opts != nil && opts.BasisWindow != (Region{}) {
+		return errors.New("A basis window can't apply to multiple bases")
+	}
+	reader, err := NewPatch(nil, patch, opts)
+	if err != nil {
+		return err
+	}
+	reader.bases = bases
+	var buffer []byte
+	for {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		cmd, data, err := reader.command()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if data != nil {
+			if _, err = output.Write(data); err != nil {
+				return err
+			}
+			continue
+		}
+		if isZeroRun(cmd.op) {
+			if err = writeZeros(output, cmd.length); err != nil {
+				return err
+			}
+			continue
+		}
+		if buffer == nil {
+			buffer = make([]byte, copyBufferSize)
+		}
+		section := io.NewSectionReader(bases[reader.basis], int64(cmd.where), int64(cmd.length))
+		copied, err := io.CopyBuffer(output, section, buffer)
+		if err != nil {
+			return err
+		}
+		if copied != int64(cmd.length) {
+			return fmt.Errorf("Copy of %d bytes at %d is outside basis %d", cmd.length, cmd.where, reader.basis)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+//
+// Copyright 2018 Daniel Reiter Horn
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS
+// OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rsync
+
+import (
+	"io"
+	"runtime"
+	"sort"
+
+	"github.com/danielrh/go-rsync/rollsum"
+)
+
+const DEFAULT_SEGMENT_SIZE = 16 << 20
+
+type segmentMatch struct {
+	pos   int64
+	block int
+	// the weak hits and false matches counted by the scan up to this match
+	weak_hits     int64
+	false_matches int64
+}
+
+type segmentResult struct {
+	start   int64
+	end     int64
+	data    []byte // input from start up to block_size-1 bytes past end
+	matches []segmentMatch
+	stats   DeltaStats
+	err     error
+}
+
+// findMatches scans buf the way RsyncPatchWriter would if it started with an
+// empty state at buf[0], stopping before the first window that starts at or
+// after stop.
+func (self *blockMatcher) findMatches(buf []byte, base int64, stop int) []segmentMatch {
+	block_size := int(self.sig.block_size)
+	limit := min(stop, len(buf)-block_size+1)
+	var matches []segmentMatch
+	for pos := 0; pos < limit; {
+		match_pos, match, _ := self.scan(buf, pos, limit, rollsum.Checksum(buf[pos:pos+block_size]))
+		if match < 0 {
+			break
+		}
+		matches = append(matches, segmentMatch{
+			pos:           base + int64(match_pos),
+			block:         match,
+			weak_hits:     self.stats.WeakHits,
+			false_matches: self.stats.FalseMatches,
+		})
+		pos = match_pos + block_size
+	}
+	return matches
+}
+
+func (self *RsyncPatchWriter) scanSegment(input io.ReaderAt, start int64, end int64, size int64) segmentResult {
+	result := segmentResult{start: start, end: end}
+	data_end := end + int64(self.sig.block_size) - 1
+	if data_end > size {
+		data_end = size
+	}
+	result.data = make([]byte, data_end-start)
+	_, result.err = io.ReadFull(io.NewSectionReader(input, start, data_end-start), result.data)
+	if result.err != nil {
+		return result
+	}
+	matcher := newBlockMatcher(&self.sig, &self.hint, &result.stats)
+	result.matches = matcher.findMatches(result.data, start, int(end-start))
+	return result
+}
+
+// emit_literals queues literal bytes, writing a literal command each time the
+// run reaches max_literal_run exactly as the serial scanner does
+func (self *RsyncPatchWriter) emit_literals(data []byte) error {
+	for len(self.pending_literals)+len(data) >= self.max_literal_run {
+		room := self.max_literal_run - len(self.pending_literals)
+		if err := self.flush_literals(data[:room], false); err != nil {
+			return err
+		}
+		data = data[room:]
+	}
+	self.pending_literals = append(self.pending_literals, data...)
+	return nil
+}
+
+// WriteDeltaParallel produces the same delta as writing the size bytes of input
+// to a RsyncPatchWriter and closing it, but scans up to opts.Parallelism
+// segments of input concurrently against one shared signature index.
+//
+// Each segment is scanned as if nothing came before it. When a match from the
+// previous segment runs past the boundary, the stitcher rescans serially from
+// the end of that match until it lands on a match the segment also found, after
+// which the two scans agree, so no match is lost or added. The search is
+// always the rolling one: opts.Aligned, RollAfterMiss and AppendOnly are
+// ignored.
+func WriteDeltaParallel(sig []byte, input io.ReaderAt, size int64, output io.Writer, opts *DeltaOptions) (DeltaStats, error) {
+	if opts == nil {
+		opts = &DeltaOptions{}
+	}
+	writer, err := NewRsyncPatchWriterWithOptions(sig, output, opts)
+	if err != nil {
+		return DeltaStats{}, err
+	}
+	if writer.chunks != nil {
+		if _, err = writer.ReadFrom(io.NewSectionReader(input, 0, size)); err == nil {
+			err = writer.Close()
+		}
+		return writer.Stats(), err
+	}
+	// Close must not finish an append-only scan the segments never made
+	writer.append_state = appendOff
+	parallelism := opts.Parallelism
+	if parallelism <= 0 {
+		parallelism = runtime.GOMAXPROCS(0)
+	}
+	block_size := int64(writer.sig.block_size)
+	segment_size := opts.SegmentSize
+	if segment_size <= 0 {
+		segment_size = DEFAULT_SEGMENT_SIZE
+	}
+	if segment_size < 4*block_size {
+		segment_size = 4 * block_size
+	}
+	num_segments := int((size + segment_size - 1) / segment_size)
+	results := make([]chan segmentResult, num_segments)
+	for index := range results {
+		results[index] = make(chan segmentResult, 1)
+	}
+	// a segment's slot is released only once it has been stitched, which
+	// bounds the memory held to parallelism+1 segments
+	slots := make(chan struct{}, parallelism)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for index := 0; index < num_segments; index++ {
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
+			}
+			start := int64(index) * segment_size
+			end := start + segment_size
+			if end > size {
+				end = size
+			}
+			go func(index int) {
+				results[index] <- writer.scanSegment(input, start, end, size)
+			}(index)
+		}
+	}()
+
+	window_limit := size - block_size + 1 // no complete window starts at or past here
+	var cursor int64                      // everything before cursor has been emitted
+	for index := 0; index < num_segments; index++ {
+		result := <-results[index]
+		if result.err != nil {
+			return writer.Stats(), result.err
+		}
+		matches := result.matches
+		if cursor > result.start {
+			matches = writer.resync(&result, cursor)
+		}
+		writer.stats.WeakHits += result.stats.WeakHits
+		writer.stats.FalseMatches += result.stats.FalseMatches
+		for _, match := range matches {
+			if err = writer.emit_literals(result.data[cursor-result.start : match.pos-result.start]); err != nil {
+				return writer.Stats(), err
+			}
+			if err = writer.flush_literals(nil, false); err != nil {
+				return writer.Stats(), err
+			}
+			if err = writer.emit_copy(match.block*int(block_size), int(block_size)); err != nil {
+				return writer.Stats(), err
+			}
+			cursor = match.pos + block_size
+		}
+		literal_end := result.end
+		if literal_end > window_limit {
+			literal_end = window_limit
+		}
+		if cursor < literal_end {
+			if err = writer.emit_literals(result.data[cursor-result.start : literal_end-result.start]); err != nil {
+				return writer.Stats(), err
+			}
+			cursor = literal_end
+		}
+		writer.progress.add(result.end - result.start)
+		<-slots
+	}
+	if cursor < size {
+		// the final partial window is left for Close, as Write would leave it
+		writer.tail = writer.tail[:size-cursor]
+		_, err = io.ReadFull(io.NewSectionReader(input, cursor, size-cursor), writer.tail)
+		if err != nil {
+			return writer.Stats(), err
+		}
+	}
+	writer.stats.InBytes = size
+	if err = writer.Close(); err != nil {
+		return writer.Stats(), err
+	}
+	return writer.Stats(), nil
+}
+
+// resync rescans result serially from cursor, where the previous segment's
+// last match ended, and returns the matches the serial scanner would find.
+// The segment's weak hits and false matches are replaced by the rescan's, up to
+// the match where the two scans agree.
+func (self *RsyncPatchWriter) resync(result *segmentResult, cursor int64) []segmentMatch {
+	block_size := int(self.sig.block_size)
+	stop := int(result.end - result.start)
+	limit := min(stop, len(result.data)-block_size+1)
+	var scratch DeltaStats
+	matcher := newBlockMatcher(&self.sig, &self.hint, &scratch)
+	var matches []segmentMatch
+	for pos := int(cursor - result.start); pos < limit; {
+		match_pos, match, _ := matcher.scan(result.data, pos, limit,
+			rollsum.Checksum(result.data[pos:pos+block_size]))
+		if match < 0 {
+			break
+		}
+		abs := result.start + int64(match_pos)
+		next := sort.Search(len(result.matches), func(i int) bool {
+			return result.matches[i].pos >= abs
+		})
+		if next < len(result.matches) && result.matches[next].pos == abs {
+			result.stats.WeakHits += scratch.WeakHits - result.matches[next].weak_hits
+			result.stats.FalseMatches += scratch.FalseMatches - result.matches[next].false_matches
+			return append(matches, result.matches[next:]...)
+		}
+		matches = append(matches, segmentMatch{pos: abs, block: match})
+		pos = match_pos + block_size
+	}
+	result.stats.WeakHits = scratch.WeakHits
+	result.stats.FalseMatches = scratch.FalseMatches
+	return matches
+}
@@ -0,0 +1,147 @@
+//
+// Copyright 2018 Daniel Reiter Horn
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS
+// OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rsync
+
+import (
+	"context"
+	"io"
+	"os"
+)
+
+// copyBufferSize is the buffer ApplyPatchFile copies through when the kernel
+// can't copy for it
+const copyBufferSize = 256 * 1024
+
+// ApplyPatchFile is ApplyPatchWithOptions for a basis and output that are both
+// files. The basis is read in place rather than loaded, and the output is
+// written from its current offset. On Linux copies run inside the kernel with
+// copy_file_range, which shares extents on filesystems with reflinks; where it
+// isn't available they are read and written as usual. Zero runs are skipped
+// over with Seek, leaving holes, so the output should have nothing past its
+// current offset.
+func ApplyPatchFile(base *os.File, patch []byte, output *os.File, opts *PatchOptions) error {
+	return ApplyPatchFileContext(context.Background(), base, patch, output, opts)
+}
+
+// ApplyPatchFileContext is ApplyPatchFile checking ctx before every command
+func ApplyPatchFileContext(ctx context.Context, base *os.File, patch []byte, output *os.File, opts *PatchOptions) error {
+	info, err := base.Stat()
+	if err != nil {
+		return err
+	}
+	reader, err := NewPatch(nil, patch, opts)
+	if err != nil {
+		return err
+	}
+	reader.base_size = int(info.Size())
+	var base_offset int64
+	if window := reader.limits.BasisWindow; window.Length != 0 {
+		if err = window.check(info.Size()); err != nil {
+			return err
+		}
+		reader.base_size = int(window.Length)
+		base_offset = window.Offset
+	}
+	var buffer []byte
+	kernel_copy := true
+	seekable := true
+	hole_end := int64(-1) // output offset after a trailing hole, which must be made part of the file
+	for {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		cmd, data, err := reader.command()
+		if err == io.EOF {
+			return extendFile(output, hole_end)
+		}
+		if err != nil {
+			return err
+		}
+		hole_end = -1
+		if data != nil {
+			if _, err = output.Write(data); err != nil {
+				return err
+			}
+			continue
+		}
+		if isZeroRun(cmd.op) {
+			if seekable {
+				if hole_end, err = output.Seek(int64(cmd.length), io.SeekCurrent); err == nil {
+					continue
+				}
+				// pipes and the like get their zeros written out
+				seekable = false
+				hole_end = -1
+			}
+			if err = writeZeros(output, cmd.length); err != nil {
+				return err
+			}
+			continue
+		}
+		where, length := base_offset+int64(cmd.where), int64(cmd.length)
+		if kernel_copy {
+			copied, err := copyFileRange(output, base, where, length)
+			where += copied
+			length -= copied
+			if err != nil {
+				// unsupported here, so stop trying and finish with plain reads
+				kernel_copy = false
+			}
+		}
+		if length == 0 {
+			continue
+		}
+		if buffer == nil {
+			buffer = make([]byte, copyBufferSize)
+		}
+		if _, err = io.CopyBuffer(output, io.NewSectionReader(base, where, length), buffer); err != nil {
+			return err
+		}
+	}
+}
+
+func writeZeros(output io.Writer, length int) error {
+	for length != 0 {
+		n, err := output.Write(zeroChunk[:min(length, len(zeroChunk))])
+		if err != nil {
+			return err
+		}
+		length -= n
+	}
+	return nil
+}
+
+// extendFile makes sure output reaches size, if the patch ended in a hole
+func extendFile(output *os.File, size int64) error {
+	if size < 0 {
+		return nil
+	}
+	info, err := output.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < size {
+		return output.Truncate(size)
+	}
+	return nil
+}
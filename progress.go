@@ -0,0 +1,98 @@
+//
+// Copyright 2018 Daniel Reiter Horn
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS
+// OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rsync
+
+type ProgressPhase int
+
+const (
+	PhaseSignature ProgressPhase = iota
+	PhaseDelta
+	PhasePatch
+)
+
+func (self ProgressPhase) String() string {
+	switch self {
+	case PhaseSignature:
+		return "signature"
+	case PhaseDelta:
+		return "delta"
+	case PhasePatch:
+		return "patch"
+	}
+	return "unknown"
+}
+
+// Progress is handed to a ProgressFunc. Done counts the bytes of input consumed
+// so far: the basis for signatures, the new file for deltas and the delta
+// itself for patches. Total is -1 when the input size is not known up front.
+type Progress struct {
+	Phase ProgressPhase
+	Done  int64
+	Total int64
+}
+
+// ProgressFunc is called from the goroutine doing the work, roughly every
+// ProgressInterval bytes and once more when the operation completes.
+type ProgressFunc func(Progress)
+
+const DEFAULT_PROGRESS_INTERVAL = 1 << 20
+
+type progressTracker struct {
+	fn       ProgressFunc
+	phase    ProgressPhase
+	interval int64
+	total    int64
+	done     int64
+	next     int64
+}
+
+func newProgressTracker(fn ProgressFunc, interval int64, phase ProgressPhase, total int64) progressTracker {
+	if interval <= 0 {
+		interval = DEFAULT_PROGRESS_INTERVAL
+	}
+	return progressTracker{
+		fn:       fn,
+		phase:    phase,
+		interval: interval,
+		total:    total,
+		next:     interval,
+	}
+}
+
+func (self *progressTracker) add(processed int64) {
+	if self.fn == nil {
+		return
+	}
+	self.done += processed
+	if self.done >= self.next {
+		self.next = self.done + self.interval
+		self.fn(Progress{Phase: self.phase, Done: self.done, Total: self.total})
+	}
+}
+
+func (self *progressTracker) finish() {
+	if self.fn == nil {
+		return
+	}
+	self.fn(Progress{Phase: self.phase, Done: self.done, Total: self.total})
+}
@@ -0,0 +1,89 @@
+//
+// Copyright 2018 Daniel Reiter Horn
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS
+// OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rsync
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// Region is a byte range of a file
+type Region struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// End is the offset just past the region
+func (self Region) End() int64 {
+	return self.Offset + self.Length
+}
+
+// Section returns the part of input in the region, seeking past the bytes
+// before it if input is an io.Seeker and reading past them otherwise
+func (self Region) Section(input io.Reader) (io.Reader, error) {
+	if seeker, ok := input.(io.Seeker); ok {
+		if _, err := seeker.Seek(self.Offset, io.SeekCurrent); err == nil {
+			return io.LimitReader(input, self.Length), nil
+		}
+	}
+	if _, err := io.CopyN(io.Discard, input, self.Offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return io.LimitReader(input, self.Length), nil
+}
+
+func (self Region) check(size int64) error {
+	if self.Offset < 0 || self.Length < 0 || self.End() > size {
+		return fmt.Errorf("Region %d+%d is outside the %d byte basis", self.Offset, self.Length, size)
+	}
+	return nil
+}
+
+// Window is the range of the basis a signature made with SigOptions.Window
+// covers
+func (self *SigFile) Window() (Region, bool) {
+	if self.window == nil {
+		return Region{}, false
+	}
+	return *self.window, true
+}
+
+// Window is the range of the basis the writer's signature covers, if it only
+// covers one. Copies count from its start unless DeltaOptions.BasisOffset
+// says otherwise, and the input should be the same range of the new file.
+func (self *RsyncPatchWriter) Window() (Region, bool) {
+	return self.sig.Window()
+}
+
+// NewSigFileRegion is NewSigFileContext for the bytes of buf in region alone.
+// Its blocks, and so the copies of deltas against it, count from the start of
+// the region; DeltaOptions.BasisOffset moves those copies back to where the
+// region sits in buf. Unlike SigOptions.Window, the region is not recorded in
+// the signature, which suits callers that keep track of it themselves.
+func NewSigFileRegion(ctx context.Context, block_size uint32, buf []byte, region Region, crypto_sig_size uint32, opts *SigOptions) (SigFile, error) {
+	if err := region.check(int64(len(buf))); err != nil {
+		return SigFile{}, err
+	}
+	return NewSigFileContext(ctx, block_size, buf[region.Offset:region.End()], crypto_sig_size, opts)
+}
@@ -0,0 +1,120 @@
+//
+// Copyright 2018 Daniel Reiter Horn
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS
+// OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package rollsum implements the rolling checksum librsync uses for the weak
+// sums in its signatures. It is an Adler-32 variant that adds 31 to every byte
+// and keeps both halves modulo 2^16, not the CRC-32 its old name suggested.
+package rollsum
+
+import "hash"
+
+// CharOffset is added to every byte so runs of zeros still change the sum
+const CharOffset = 31
+
+// Size of the checksum in bytes
+const Size = 4
+
+// Rollsum is the running state of a checksum over a window of bytes. Bytes can
+// be added with Write or Rollin, removed from the front with Rollout, or both
+// at once with Roll. The zero value is an empty window.
+type Rollsum struct {
+	count uint32
+	s1    uint16
+	s2    uint16
+}
+
+var _ hash.Hash32 = (*Rollsum)(nil)
+
+func New() *Rollsum {
+	return &Rollsum{}
+}
+
+// Checksum returns the rolling checksum of data
+func Checksum(data []byte) uint32 {
+	var sum Rollsum
+	_, _ = sum.Write(data)
+	return sum.Sum32()
+}
+
+// Write appends data to the window. It never returns an error.
+func (self *Rollsum) Write(data []byte) (int, error) {
+	s1 := self.s1
+	s2 := self.s2
+	for _, item := range data {
+		s1 += uint16(item)
+		s2 += s1
+	}
+	length := uint32(len(data))
+	s1 += uint16(length * CharOffset)
+	s2 += uint16(((length * (length + 1)) / 2) * CharOffset)
+	self.s1 = s1
+	self.s2 = s2
+	self.count += length
+	return len(data), nil
+}
+
+// Rollin appends one byte to the window
+func (self *Rollsum) Rollin(in byte) {
+	self.s1 += uint16(in) + CharOffset
+	self.s2 += self.s1
+	self.count += 1
+}
+
+// Rollout removes out, the oldest byte, from the window
+func (self *Rollsum) Rollout(out byte) {
+	self.s1 -= uint16(out) + CharOffset
+	self.s2 -= uint16(self.count) * (uint16(out) + CharOffset)
+	self.count -= 1
+}
+
+// Roll slides the window one byte: out, the oldest byte, leaves and in joins
+func (self *Rollsum) Roll(out byte, in byte) {
+	self.s1 += uint16(in) - uint16(out)
+	self.s2 += self.s1 - uint16(self.count)*(uint16(out)+CharOffset)
+}
+
+// Count is the number of bytes in the window
+func (self *Rollsum) Count() int {
+	return int(self.count)
+}
+
+func (self *Rollsum) Sum32() uint32 {
+	return uint32(self.s1) | (uint32(self.s2) << 16)
+}
+
+// Sum appends the big endian checksum to data, the byte order signatures use
+func (self *Rollsum) Sum(data []byte) []byte {
+	sum := self.Sum32()
+	return append(data, byte(sum>>24), byte(sum>>16), byte(sum>>8), byte(sum))
+}
+
+func (self *Rollsum) Reset() {
+	*self = Rollsum{}
+}
+
+func (self *Rollsum) Size() int {
+	return Size
+}
+
+func (self *Rollsum) BlockSize() int {
+	return 1
+}
@@ -0,0 +1,87 @@
+//
+// Copyright 2018 Daniel Reiter Horn
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS
+// OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rollsum
+
+import (
+	"fmt"
+	"testing"
+)
+
+func expect(sum *Rollsum, count int, digest uint32) {
+	if sum.Count() != count || sum.Sum32() != digest {
+		panic(fmt.Sprintf("count %d digest 0x%08x, want %d 0x%08x", sum.Count(), sum.Sum32(), count, digest))
+	}
+}
+
+// the same sequence and digests as librsync's tests/rollsum_test.c
+func TestLibrsyncReference(t *testing.T) {
+	var sum Rollsum
+	expect(&sum, 0, 0x00000000)
+	sum.Rollin(0) // [ 0 ]
+	expect(&sum, 1, 0x001f001f)
+	sum.Rollin(1)
+	sum.Rollin(2)
+	sum.Rollin(3) // [ 0, 1, 2, 3 ]
+	expect(&sum, 4, 0x01400082)
+	sum.Roll(0, 4) // [ 1, 2, 3, 4 ]
+	expect(&sum, 4, 0x014a0086)
+	sum.Roll(1, 5)
+	sum.Roll(2, 6)
+	sum.Roll(3, 7) // [ 4, 5, 6, 7 ]
+	expect(&sum, 4, 0x01680092)
+	sum.Rollout(4) // [ 5, 6, 7 ]
+	expect(&sum, 3, 0x00dc006f)
+	sum.Rollout(5)
+	sum.Rollout(6)
+	sum.Rollout(7) // []
+	expect(&sum, 0, 0x00000000)
+	var buf [256]byte
+	for index := range buf {
+		buf[index] = byte(index)
+	}
+	_, _ = sum.Write(buf[:])
+	expect(&sum, 256, 0x3a009e80)
+}
+
+func TestRollMatchesWrite(t *testing.T) {
+	data := []byte("The wheels on the bus go round and round, round and round")
+	const window = 11
+	sum := New()
+	_, _ = sum.Write(data[:window])
+	for pos := 0; pos+window < len(data); pos++ {
+		if sum.Sum32() != Checksum(data[pos:pos+window]) {
+			panic(fmt.Sprintf("rolled sum differs at %d", pos))
+		}
+		sum.Roll(data[pos], data[pos+window])
+	}
+	for pos := len(data) - window; pos < len(data); pos++ {
+		if sum.Sum32() != Checksum(data[pos:]) {
+			panic(fmt.Sprintf("rolled out sum differs at %d", pos))
+		}
+		sum.Rollout(data[pos])
+	}
+	expect(sum, 0, 0)
+	if got := fmt.Sprintf("%x", New().Sum([]byte{0xff})); got != "ff00000000" {
+		panic(got)
+	}
+}
@@ -0,0 +1,292 @@
+//
+// Copyright 2018 Daniel Reiter Horn
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS
+// OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rsync
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/danielrh/go-rsync/cdc"
+)
+
+// EXTENDED_SIG_MAGIC starts signatures whose header carries more than the
+// classic block and strong sum sizes. librsync can't read them.
+var EXTENDED_SIG_MAGIC = [4]byte{0x72, 0x73, 0x01, 0x7e}
+
+const EXTENDED_SIG_VERSION = 1
+
+// EXTENDED_SIG_VERSION_CHUNKED marks signatures of content-defined chunks,
+// whose records start with the chunk length instead of a weak sum. The new
+// version keeps readers that would skip SIG_TAG_CHUNKING from misreading them.
+const EXTENDED_SIG_VERSION_CHUNKED = 2
+
+// An extended header is the magic, version, block size, strong sum size and
+// the byte length of the fields that follow, each of them a tag, a length and
+// that many bytes of value. All integers are big endian uint32s. Readers skip
+// tags they don't know.
+const EXTENDED_HEADER_SIZE = 20
+
+const (
+	SIG_TAG_HASH         uint32 = 1 // magic of the strong hash
+	SIG_TAG_SEED         uint32 = 2 // seed mixed into every strong hash
+	SIG_TAG_BASIS_LENGTH uint32 = 3 // uint64 length of the basis
+	SIG_TAG_FILE_HASH    uint32 = 4 // magic of a strong hash, then its sum of the whole basis
+	SIG_TAG_CREATED      uint32 = 5 // int64 nanoseconds since the Unix epoch
+	SIG_TAG_METADATA     uint32 = 6 // uint32 key length, the key, then the value
+	SIG_TAG_CHUNKING     uint32 = 7 // uint32 minimum, average and maximum chunk lengths
+	SIG_TAG_WINDOW       uint32 = 8 // uint64 offset and length of the range of the basis signed
+)
+
+// SigHeader is the file level metadata an extended signature can carry. Fields
+// missing from the header read as a BasisLength of -1, a nil FileHash and a
+// zero Created.
+type SigHeader struct {
+	BasisLength  int64
+	FileHashAlgo StrongHash
+	FileHash     []byte
+	Created      time.Time
+	Metadata     map[string]string
+}
+
+// Header returns the signature's file level metadata, if it has any
+func (self *SigFile) Header() (SigHeader, bool) {
+	if self.header == nil {
+		return SigHeader{BasisLength: -1}, false
+	}
+	return *self.header, true
+}
+
+const DEFAULT_SEED_SIZE = 16
+
+// NewSeed returns DEFAULT_SEED_SIZE random bytes for SigOptions.Seed
+func NewSeed() ([]byte, error) {
+	seed := make([]byte, DEFAULT_SEED_SIZE)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, err
+	}
+	return seed, nil
+}
+
+func (self *SigFile) extended() bool {
+	return len(self.seed) != 0 || self.header != nil || self.chunked() || self.window != nil
+}
+
+// Seed is the salt mixed into the strong hashes, nil for unsalted signatures
+func (self *SigFile) Seed() []byte {
+	return self.seed
+}
+
+func appendU32(buffer []byte, val uint32) []byte {
+	be := u32_to_be(val)
+	return append(buffer, be[:]...)
+}
+
+func appendU64(buffer []byte, val uint64) []byte {
+	buffer = appendU32(buffer, uint32(val>>32))
+	return appendU32(buffer, uint32(val))
+}
+
+func be_to_u64(data []byte) uint64 {
+	return uint64(be_to_u32(data))<<32 | uint64(be_to_u32(data[4:]))
+}
+
+func appendSigField(buffer []byte, tag uint32, value []byte) []byte {
+	buffer = appendU32(buffer, tag)
+	buffer = appendU32(buffer, uint32(len(value)))
+	return append(buffer, value...)
+}
+
+// appendHeader appends the classic header, or the extended one if the
+// signature needs it
+func (self *SigFile) appendHeader(buffer []byte) []byte {
+	magic := self.magic()
+	buffer = append(buffer, magic[:]...)
+	if !self.extended() {
+		buffer = appendU32(buffer, self.block_size)
+		return appendU32(buffer, self.crypto_hash_size)
+	}
+	hash_magic := self.Hash().Magic()
+	var fields []byte
+	fields = appendSigField(fields, SIG_TAG_HASH, hash_magic[:])
+	if len(self.seed) != 0 {
+		fields = appendSigField(fields, SIG_TAG_SEED, self.seed)
+	}
+	version := uint32(EXTENDED_SIG_VERSION)
+	if self.chunked() {
+		version = EXTENDED_SIG_VERSION_CHUNKED
+		chunking := appendU32(nil, uint32(self.chunking.Min))
+		chunking = appendU32(chunking, uint32(self.chunking.Avg))
+		chunking = appendU32(chunking, uint32(self.chunking.Max))
+		fields = appendSigField(fields, SIG_TAG_CHUNKING, chunking)
+	}
+	if window := self.window; window != nil {
+		value := appendU64(nil, uint64(window.Offset))
+		fields = appendSigField(fields, SIG_TAG_WINDOW, appendU64(value, uint64(window.Length)))
+	}
+	if header := self.header; header != nil {
+		if header.BasisLength >= 0 {
+			fields = appendSigField(fields, SIG_TAG_BASIS_LENGTH, appendU64(nil, uint64(header.BasisLength)))
+		}
+		if header.FileHash != nil {
+			file_hash_magic := header.FileHashAlgo.Magic()
+			fields = appendSigField(fields, SIG_TAG_FILE_HASH, append(file_hash_magic[:], header.FileHash...))
+		}
+		if !header.Created.IsZero() {
+			fields = appendSigField(fields, SIG_TAG_CREATED, appendU64(nil, uint64(header.Created.UnixNano())))
+		}
+		keys := make([]string, 0, len(header.Metadata))
+		for key := range header.Metadata {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			entry := appendU32(nil, uint32(len(key)))
+			entry = append(append(entry, key...), header.Metadata[key]...)
+			fields = appendSigField(fields, SIG_TAG_METADATA, entry)
+		}
+	}
+	buffer = appendU32(buffer, version)
+	buffer = appendU32(buffer, self.block_size)
+	buffer = appendU32(buffer, self.crypto_hash_size)
+	buffer = appendU32(buffer, uint32(len(fields)))
+	return append(buffer, fields...)
+}
+
+// readHeader returns the header being read into, starting it if need be
+func (self *SigFile) readHeader() *SigHeader {
+	if self.header == nil {
+		self.header = &SigHeader{BasisLength: -1, Metadata: map[string]string{}}
+	}
+	return self.header
+}
+
+// readSigHeader fills in everything but the block records from either header
+// format, returning the header's length
+func readSigHeader(on_disk_format []byte) (SigFile, int, error) {
+	if !bytes.Equal(on_disk_format[:4], EXTENDED_SIG_MAGIC[:]) {
+		strong, ok := strongHashForMagic(on_disk_format[:4])
+		if !ok {
+			return SigFile{}, 0, fmt.Errorf("File sig not recognized %x: %w", on_disk_format[:4], ErrBadMagic)
+		}
+		return SigFile{
+			block_size:       be_to_u32(on_disk_format[4:8]),
+			crypto_hash_size: be_to_u32(on_disk_format[8:HEADER_SIZE]),
+			hash:             strong,
+		}, HEADER_SIZE, nil
+	}
+	if len(on_disk_format) < EXTENDED_HEADER_SIZE {
+		return SigFile{}, 0, fmt.Errorf("Extended signature header truncated: %w", ErrInputEnded)
+	}
+	version := be_to_u32(on_disk_format[4:8])
+	if version != EXTENDED_SIG_VERSION && version != EXTENDED_SIG_VERSION_CHUNKED {
+		return SigFile{}, 0, fmt.Errorf("Extended signature version %d not supported", version)
+	}
+	sig := SigFile{
+		block_size:       be_to_u32(on_disk_format[8:12]),
+		crypto_hash_size: be_to_u32(on_disk_format[12:16]),
+	}
+	fields_size := be_to_u32(on_disk_format[16:EXTENDED_HEADER_SIZE])
+	if uint64(fields_size) > uint64(len(on_disk_format)-EXTENDED_HEADER_SIZE) {
+		return SigFile{}, 0, fmt.Errorf("Extended signature header truncated: %w", ErrInputEnded)
+	}
+	header_size := EXTENDED_HEADER_SIZE + int(fields_size)
+	for fields := on_disk_format[EXTENDED_HEADER_SIZE:header_size]; len(fields) != 0; {
+		if len(fields) < 8 {
+			return SigFile{}, 0, fmt.Errorf("Extended signature field truncated: %w", ErrInputEnded)
+		}
+		tag, length := be_to_u32(fields[0:4]), be_to_u32(fields[4:8])
+		if uint64(length) > uint64(len(fields)-8) {
+			return SigFile{}, 0, fmt.Errorf("Extended signature field %d truncated: %w", tag, ErrInputEnded)
+		}
+		value := fields[8 : 8+int(length)]
+		fields = fields[8+int(length):]
+		switch tag {
+		case SIG_TAG_HASH:
+			strong, ok := strongHashForMagic(value)
+			if len(value) != 4 || !ok {
+				return SigFile{}, 0, fmt.Errorf("Strong hash %x not recognized", value)
+			}
+			sig.hash = strong
+		case SIG_TAG_SEED:
+			sig.seed = value
+		case SIG_TAG_BASIS_LENGTH, SIG_TAG_CREATED:
+			if len(value) != 8 {
+				return SigFile{}, 0, fmt.Errorf("Extended signature field %d has length %d", tag, len(value))
+			}
+			if tag == SIG_TAG_BASIS_LENGTH {
+				sig.readHeader().BasisLength = int64(be_to_u64(value))
+			} else {
+				sig.readHeader().Created = time.Unix(0, int64(be_to_u64(value)))
+			}
+		case SIG_TAG_FILE_HASH:
+			var strong StrongHash
+			ok := len(value) >= 4
+			if ok {
+				strong, ok = strongHashForMagic(value[:4])
+			}
+			if !ok {
+				return SigFile{}, 0, errors.New("Whole file hash not recognized")
+			}
+			sig.readHeader().FileHashAlgo = strong
+			sig.readHeader().FileHash = value[4:]
+		case SIG_TAG_METADATA:
+			if len(value) < 4 || uint64(be_to_u32(value)) > uint64(len(value)-4) {
+				return SigFile{}, 0, fmt.Errorf("Extended signature metadata truncated: %w", ErrInputEnded)
+			}
+			key_end := 4 + int(be_to_u32(value))
+			sig.readHeader().Metadata[string(value[4:key_end])] = string(value[key_end:])
+		case SIG_TAG_CHUNKING:
+			if len(value) != 12 {
+				return SigFile{}, 0, fmt.Errorf("Extended signature field %d has length %d", tag, len(value))
+			}
+			sig.chunking = cdc.Params{
+				Min: int(be_to_u32(value[0:4])),
+				Avg: int(be_to_u32(value[4:8])),
+				Max: int(be_to_u32(value[8:12])),
+			}
+			if err := sig.chunking.Validate(); err != nil {
+				return SigFile{}, 0, err
+			}
+		case SIG_TAG_WINDOW:
+			if len(value) != 16 {
+				return SigFile{}, 0, fmt.Errorf("Extended signature field %d has length %d", tag, len(value))
+			}
+			window := Region{Offset: int64(be_to_u64(value[0:8])), Length: int64(be_to_u64(value[8:16]))}
+			if window.Offset < 0 || window.Length <= 0 || window.End() < 0 {
+				return SigFile{}, 0, fmt.Errorf("Signature window %d+%d is invalid", window.Offset, window.Length)
+			}
+			sig.window = &window
+		}
+	}
+	if sig.chunked() != (version == EXTENDED_SIG_VERSION_CHUNKED) {
+		return SigFile{}, 0, fmt.Errorf("Extended signature version %d doesn't match its chunking", version)
+	}
+	if sig.hash == nil {
+		return SigFile{}, 0, errors.New("Extended signature names no strong hash")
+	}
+	return sig, header_size, nil
+}
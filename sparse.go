@@ -0,0 +1,213 @@
+//
+// Copyright 2018 Daniel Reiter Horn
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS
+// OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rsync
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/danielrh/go-rsync/rollsum"
+)
+
+// MIN_ZERO_RUN is the shortest run of unmatched zeros worth a zero run command
+// rather than staying part of a literal
+const MIN_ZERO_RUN = 64
+
+func isZero(data []byte) bool {
+	for len(data) != 0 {
+		n := min(len(data), len(zeroChunk))
+		if !bytes.Equal(data[:n], zeroChunk[:n]) {
+			return false
+		}
+		data = data[n:]
+	}
+	return true
+}
+
+// zeroBlockSig is the record of a whole block of zeros
+func (self *SigFile) zeroBlockSig() Sig {
+	zeros := make([]byte, self.block_size)
+	hasher := self.newHasher()
+	_, _ = hasher.Write(zeros)
+	return Sig{
+		crc32:       rollsum.Checksum(zeros),
+		crypto_hash: hasher.Sum(nil)[:self.crypto_hash_size],
+	}
+}
+
+// zero_blocks reports which of the signature's blocks are all zero
+func (self *SigFile) zero_blocks() []bool {
+	zero := self.zeroBlockSig()
+	ret := make([]bool, len(self.signatures))
+	for index, item := range self.signatures {
+		ret[index] = item.crc32 == zero.crc32 && bytes.Equal(item.crypto_hash, zero.crypto_hash)
+	}
+	return ret
+}
+
+func select_zero_command(len int) []byte {
+	var output [9]byte
+	logLenNumBytes := writeVarInt(len, output[1:])
+	output[0] = RS_OP_ZERO_N1 + byte(logLenNumBytes)
+	return output[:1+(1<<logLenNumBytes)]
+}
+
+// flush_zeros writes the pending zero run, if there is one
+func (self *RsyncPatchWriter) flush_zeros() error {
+	if self.pending_zeros == 0 {
+		return nil
+	}
+	cmd := select_zero_command(self.pending_zeros)
+	self.stats.ZeroCmds += 1
+	self.stats.ZeroBytes += int64(self.pending_zeros)
+	self.stats.ZeroCmdBytes += int64(len(cmd))
+	self.pending_zeros = 0
+	_, err := self.output.Write(cmd)
+	return err
+}
+
+func (self *RsyncPatchWriter) write_literal(data []byte) error {
+	if err := self.flush_zeros(); err != nil {
+		return err
+	}
+	cmd := select_insert_command(len(data))
+	self.stats.LiteralCmds += 1
+	self.stats.LiteralBytes += int64(len(data))
+	self.stats.LiteralCmdBytes += int64(len(cmd))
+	if _, err := self.output.Write(cmd); err != nil {
+		return err
+	}
+	_, err := self.output.Write(data)
+	return err
+}
+
+// write_literals_and_zeros writes data as literals of at most max_literal_run
+// bytes, except that runs of at least MIN_ZERO_RUN zeros, or any zeros
+// continuing a pending run, join the pending zero run
+func (self *RsyncPatchWriter) write_literals_and_zeros(data []byte) error {
+	for len(data) != 0 {
+		start := 0
+		end := 0
+		for start < len(data) {
+			for start < len(data) && data[start] != 0 {
+				start++
+			}
+			for end = start; end < len(data) && data[end] == 0; end++ {
+			}
+			if end-start >= MIN_ZERO_RUN || (start == 0 && self.pending_zeros != 0) {
+				break
+			}
+			start = end
+		}
+		// data can be longer than max_literal_run, so its literals are too
+		for literal := data[:start]; len(literal) != 0; {
+			run := literal[:min(len(literal), self.max_literal_run)]
+			if err := self.write_literal(run); err != nil {
+				return err
+			}
+			literal = literal[len(run):]
+		}
+		self.pending_zeros += end - start
+		data = data[max(start, end):]
+	}
+	return nil
+}
+
+// write_zeros feeds n zeros to Write
+func (self *RsyncPatchWriter) write_zeros(n int64) error {
+	for n != 0 {
+		chunk := zeroChunk[:min64(n, int64(len(zeroChunk)))]
+		if _, err := self.Write(chunk); err != nil {
+			return err
+		}
+		n -= int64(len(chunk))
+	}
+	return nil
+}
+
+// write_hole feeds the n zeros of a hole in the input. Only a block at either
+// end of a long hole is scanned: every window inside it is all zero, so
+// whether or not it would match, its bytes end up in the zero run.
+func (self *RsyncPatchWriter) write_hole(n int64) error {
+	block_size := int64(self.sig.block_size)
+	if self.append_state == appendTail {
+		if err := self.flush_literals(nil, false); err != nil {
+			return err
+		}
+		self.pending_zeros += int(n)
+		self.stats.InBytes += n
+		self.progress.add(n)
+		return nil
+	}
+	if n < 3*block_size || self.append_state == appendScanning || self.chunks != nil {
+		return self.write_zeros(n)
+	}
+	if err := self.write_zeros(block_size); err != nil {
+		return err
+	}
+	// the untested windows left in the tail start inside the hole
+	tail := self.tail
+	self.tail = self.tail[:0]
+	if err := self.flush_literals(tail, false); err != nil {
+		return err
+	}
+	interior := n - 2*block_size
+	self.pending_zeros += int(interior)
+	self.stats.InBytes += interior
+	self.progress.add(interior)
+	return self.write_zeros(block_size)
+}
+
+// readFromSparse is ReadFrom for a file whose holes are skipped rather than
+// read. It falls back to reading everything when the file isn't regular.
+func (self *RsyncPatchWriter) readFromSparse(file *os.File, buffer []byte) (int64, error) {
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return self.readAll(file, buffer)
+	}
+	start, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return self.readAll(file, buffer)
+	}
+	size := info.Size()
+	for pos := start; pos < size; {
+		data, hole := dataRegion(file, pos, size)
+		if data > pos {
+			if err = self.write_hole(data - pos); err != nil {
+				return pos - start, err
+			}
+		}
+		n, err := self.readAll(io.NewSectionReader(file, data, hole-data), buffer)
+		pos = data + n
+		if err != nil {
+			return pos - start, err
+		}
+		if pos < hole {
+			// the file shrank under us
+			break
+		}
+	}
+	end, err := file.Seek(0, io.SeekEnd)
+	return end - start, err
+}
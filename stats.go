@@ -0,0 +1,68 @@
+//
+// Copyright 2018 Daniel Reiter Horn
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS
+// OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rsync
+
+import "fmt"
+
+// DeltaStats mirrors librsync's rs_stats for delta generation. The CmdBytes
+// fields count command header overhead only, not the literal payload.
+type DeltaStats struct {
+	LiteralCmds     int64
+	LiteralBytes    int64
+	LiteralCmdBytes int64
+	CopyCmds        int64
+	CopyBytes       int64
+	CopyCmdBytes    int64
+	ZeroCmds        int64 // zero runs, only written with DeltaOptions.ZeroRuns
+	ZeroBytes       int64
+	ZeroCmdBytes    int64
+	WeakHits        int64 // windows whose rolling checksum was found in the signature
+	FalseMatches    int64 // weak hits where no strong hash agreed
+	InBytes         int64 // bytes of the new file scanned
+	SigBlocks       int
+	BlockSize       uint32
+}
+
+// OutBytes is the size of the delta body, excluding the magic number and the
+// end command
+func (self DeltaStats) OutBytes() int64 {
+	return self.LiteralBytes + self.LiteralCmdBytes + self.CopyCmdBytes + self.ZeroCmdBytes
+}
+
+func (self DeltaStats) String() string {
+	if self.ZeroCmds != 0 {
+		return fmt.Sprintf("%s zero[%d cmds, %d bytes, %d cmdbytes]", self.librsyncString(),
+			self.ZeroCmds, self.ZeroBytes, self.ZeroCmdBytes)
+	}
+	return self.librsyncString()
+}
+
+// librsyncString formats the stats the way librsync's rs_format_stats does
+func (self DeltaStats) librsyncString() string {
+	return fmt.Sprintf("literal[%d cmds, %d bytes, %d cmdbytes] "+
+		"copy[%d cmds, %d bytes, %d cmdbytes, %d false, %d weak hits] "+
+		"signature[%d blocks, %d bytes per block] in-bytes=%d",
+		self.LiteralCmds, self.LiteralBytes, self.LiteralCmdBytes,
+		self.CopyCmds, self.CopyBytes, self.CopyCmdBytes, self.FalseMatches, self.WeakHits,
+		self.SigBlocks, self.BlockSize, self.InBytes)
+}
@@ -0,0 +1,172 @@
+//
+// Copyright 2018 Daniel Reiter Horn
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS
+// OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rsync
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/md4"
+)
+
+// StrongHash is a strong checksum a signature can be built with. Its magic is
+// the first four bytes of any signature using it, which is how a signature
+// names its hash on disk.
+type StrongHash interface {
+	Name() string
+	New() hash.Hash
+	Size() int // digest length in bytes, the most a signature may keep
+	Magic() [4]byte
+}
+
+type strongHash struct {
+	name    string
+	factory func() hash.Hash
+	size    int
+	magic   [4]byte
+}
+
+func (self *strongHash) Name() string   { return self.name }
+func (self *strongHash) New() hash.Hash { return self.factory() }
+func (self *strongHash) Size() int      { return self.size }
+func (self *strongHash) Magic() [4]byte { return self.magic }
+
+// NewStrongHash wraps a hash.Hash factory as a StrongHash, for RegisterStrongHash
+func NewStrongHash(name string, magic [4]byte, size int, factory func() hash.Hash) StrongHash {
+	return &strongHash{name: name, factory: factory, size: size, magic: magic}
+}
+
+// SHA256_MAGIC is not a librsync format; only this package reads it.
+var SHA256_MAGIC = [4]byte{0x72, 0x73, 0x01, 0x38}
+
+const BLAKE2_SUM_SIZE = 32
+const SHA256_SUM_SIZE = sha256.Size
+
+func newBlake2b() hash.Hash {
+	hasher, _ := blake2b.New256(nil)
+	return hasher
+}
+
+// MD4 is what rdiff uses by default and what NewSigFile picks; BLAKE2 matches
+// rdiff's -H blake2.
+var (
+	MD4    = NewStrongHash("md4", MD4_MAGIC, MD4_SUM_SIZE, md4.New)
+	BLAKE2 = NewStrongHash("blake2", BLAKE5_MAGIC, BLAKE2_SUM_SIZE, newBlake2b)
+	SHA256 = NewStrongHash("sha256", SHA256_MAGIC, SHA256_SUM_SIZE, sha256.New)
+)
+
+var strongHashes = struct {
+	sync.RWMutex
+	by_name  map[string]StrongHash
+	by_magic map[[4]byte]StrongHash
+}{
+	by_name:  map[string]StrongHash{},
+	by_magic: map[[4]byte]StrongHash{},
+}
+
+func init() {
+	for _, item := range []StrongHash{MD4, BLAKE2, SHA256} {
+		if err := RegisterStrongHash(item); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterStrongHash makes hash available to LookupStrongHash and lets
+// DeserializeSigFileView read signatures carrying its magic. Names and magics
+// must both be unique.
+func RegisterStrongHash(hash StrongHash) error {
+	if hash.Size() <= 0 {
+		return fmt.Errorf("Strong hash %q has digest size %d", hash.Name(), hash.Size())
+	}
+	strongHashes.Lock()
+	defer strongHashes.Unlock()
+	if _, ok := strongHashes.by_name[hash.Name()]; ok {
+		return fmt.Errorf("Strong hash %q is already registered", hash.Name())
+	}
+	if hash.Magic() == EXTENDED_SIG_MAGIC {
+		return fmt.Errorf("Strong hash %q can't use the extended signature magic", hash.Name())
+	}
+	if other, ok := strongHashes.by_magic[hash.Magic()]; ok {
+		return fmt.Errorf("Strong hash %q has the same magic as %q", hash.Name(), other.Name())
+	}
+	strongHashes.by_name[hash.Name()] = hash
+	strongHashes.by_magic[hash.Magic()] = hash
+	return nil
+}
+
+// LookupStrongHash returns the registered hash called name
+func LookupStrongHash(name string) (StrongHash, bool) {
+	strongHashes.RLock()
+	defer strongHashes.RUnlock()
+	hash, ok := strongHashes.by_name[name]
+	return hash, ok
+}
+
+// StrongHashNames lists the registered hashes, sorted
+func StrongHashNames() []string {
+	strongHashes.RLock()
+	defer strongHashes.RUnlock()
+	names := make([]string, 0, len(strongHashes.by_name))
+	for name := range strongHashes.by_name {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func strongHashForMagic(magic []byte) (StrongHash, bool) {
+	var key [4]byte
+	copy(key[:], magic)
+	strongHashes.RLock()
+	defer strongHashes.RUnlock()
+	hash, ok := strongHashes.by_magic[key]
+	return hash, ok
+}
+
+// seededHash hashes a signature's seed ahead of the data after every Reset
+type seededHash struct {
+	hash.Hash
+	seed []byte
+}
+
+func (self *seededHash) Reset() {
+	self.Hash.Reset()
+	_, _ = self.Hash.Write(self.seed)
+}
+
+// newHasher returns a hasher for the signature's strong sums, seeded if the
+// signature is
+func (self *SigFile) newHasher() hash.Hash {
+	hasher := self.Hash().New()
+	if len(self.seed) == 0 {
+		return hasher
+	}
+	seeded := &seededHash{Hash: hasher, seed: self.seed}
+	seeded.Reset()
+	return seeded
+}
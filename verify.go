@@ -0,0 +1,200 @@
+//
+// Copyright 2018 Daniel Reiter Horn
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS
+// OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rsync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/danielrh/go-rsync/cdc"
+	"github.com/danielrh/go-rsync/rollsum"
+)
+
+// BlockMismatch is a block whose contents no longer agree with its signature
+// record. Weak and Strong say which of the two sums differ.
+type BlockMismatch struct {
+	Index  int   `json:"index"`
+	Offset int64 `json:"offset"`
+	Weak   bool  `json:"weak"`
+	Strong bool  `json:"strong"`
+}
+
+// VerifyReport is the result of checking a file against an earlier signature.
+// Blocks past the end of the shorter of the two aren't compared; the length
+// change covers them. Unless the signature's extended header records the
+// basis length, a change in length within the final block only shows up as
+// that block mismatching.
+type VerifyReport struct {
+	BlockSize     uint32          `json:"block_size"`
+	SigBlocks     int             `json:"sig_blocks"`
+	FileBlocks    int             `json:"file_blocks"`
+	FileLength    int64           `json:"file_length"`
+	LengthChanged bool            `json:"length_changed"`
+	Mismatches    []BlockMismatch `json:"mismatches"`
+}
+
+// OK is true when every block matched and the file is as long as the basis
+// the signature was made from
+func (self *VerifyReport) OK() bool {
+	return !self.LengthChanged && len(self.Mismatches) == 0
+}
+
+// VerifyAgainstSignature reads an on-disk signature from sig and checks file
+// against it block by block
+func VerifyAgainstSignature(sig, file io.Reader) (VerifyReport, error) {
+	sig_data, err := io.ReadAll(sig)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	sig_file, err := DeserializeSigFileView(sig_data)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	return sig_file.Verify(file)
+}
+
+// Verify checks file against the signature block by block, recomputing both
+// sums of every block. Only the signature's window of file is checked, if it
+// has one. The file is cut into content-defined chunks the way a
+// chunked signature's basis was, and each chunk compared on its length and
+// strong sum, which Strong reports.
+func (self *SigFile) Verify(file io.Reader) (VerifyReport, error) {
+	report := VerifyReport{
+		BlockSize:  self.block_size,
+		SigBlocks:  len(self.signatures),
+		Mismatches: []BlockMismatch{},
+	}
+	if self.block_size == 0 {
+		return report, fmt.Errorf("Signature has a block size of 0")
+	}
+	if window, ok := self.Window(); ok {
+		var err error
+		if file, err = window.Section(file); err != nil {
+			return report, err
+		}
+	}
+	if self.chunked() {
+		return self.verify_chunks(file, report)
+	}
+	hasher := self.newHasher()
+	digest := make([]byte, 0, self.Hash().Size())
+	block := make([]byte, self.block_size)
+	for {
+		n, err := io.ReadFull(file, block)
+		if n > 0 {
+			index := report.FileBlocks
+			report.FileBlocks += 1
+			report.FileLength += int64(n)
+			if index < len(self.signatures) {
+				expected := self.signatures[index]
+				hasher.Reset()
+				_, _ = hasher.Write(block[:n])
+				strong := hasher.Sum(digest[:0])[:self.crypto_hash_size]
+				mismatch := BlockMismatch{
+					Index:  index,
+					Offset: int64(index) * int64(self.block_size),
+					Weak:   rollsum.Checksum(block[:n]) != expected.crc32,
+					Strong: !bytes.Equal(strong, expected.crypto_hash),
+				}
+				if mismatch.Weak || mismatch.Strong {
+					report.Mismatches = append(report.Mismatches, mismatch)
+				}
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return report, err
+		}
+	}
+	report.LengthChanged = report.FileBlocks != report.SigBlocks
+	if header, ok := self.Header(); ok && header.BasisLength >= 0 {
+		report.LengthChanged = report.FileLength != header.BasisLength
+	}
+	return report, nil
+}
+
+func (self *SigFile) verify_chunks(file io.Reader, report VerifyReport) (VerifyReport, error) {
+	hasher := self.newHasher()
+	digest := make([]byte, 0, self.Hash().Size())
+	chunker := cdc.NewChunker(file, self.chunking)
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return report, err
+		}
+		index := report.FileBlocks
+		report.FileBlocks += 1
+		if index < len(self.signatures) {
+			expected := self.signatures[index]
+			hasher.Reset()
+			_, _ = hasher.Write(chunk)
+			strong := hasher.Sum(digest[:0])[:self.crypto_hash_size]
+			if len(chunk) != int(expected.length) || !bytes.Equal(strong, expected.crypto_hash) {
+				report.Mismatches = append(report.Mismatches, BlockMismatch{
+					Index:  index,
+					Offset: report.FileLength,
+					Strong: true,
+				})
+			}
+		}
+		report.FileLength += int64(len(chunk))
+	}
+	report.LengthChanged = report.FileBlocks != report.SigBlocks
+	if header, ok := self.Header(); ok && header.BasisLength >= 0 {
+		report.LengthChanged = report.FileLength != header.BasisLength
+	}
+	return report, nil
+}
+
+func (self *VerifyReport) WriteText(output io.Writer) error {
+	_, err := fmt.Fprintf(output, "verify block_size=%d sig_blocks=%d file_blocks=%d file_length=%d length_changed=%t mismatches=%d\n",
+		self.BlockSize, self.SigBlocks, self.FileBlocks, self.FileLength, self.LengthChanged, len(self.Mismatches))
+	if err != nil {
+		return err
+	}
+	for _, mismatch := range self.Mismatches {
+		_, err = fmt.Fprintf(output, "block %d offset=%d weak=%s strong=%s\n",
+			mismatch.Index, mismatch.Offset, sumState(mismatch.Weak), sumState(mismatch.Strong))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sumState(mismatch bool) string {
+	if mismatch {
+		return "changed"
+	}
+	return "ok"
+}
+
+func (self *VerifyReport) WriteJSON(output io.Writer) error {
+	return writeJSON(output, self)
+}